@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+)
+
+// bencodeMaxDepth is the nesting limit of lists and dictionaries, as in
+// libtorrent's bdecode.
+const bencodeMaxDepth = 100
+
+// BencodeError is a decoding error at a byte offset. Its messages are the
+// ones of errorStrings, which libtorrent reports for the same errors.
+type BencodeError struct {
+	Code   int
+	Offset int
+}
+
+func (e *BencodeError) Error() string {
+	return fmt.Sprintf("%s at offset %d", errorStrings[e.Code], e.Offset)
+}
+
+// bdecoder decodes bencoded data into int64, string, []interface{} and
+// map[string]interface{} values.
+type bdecoder struct {
+	data []byte
+	pos  int
+	// spans records where the values of the top level dictionary are,
+	// to hash the info dictionary as it is in the file.
+	spans map[string][2]int
+}
+
+// bdecode decodes a single bencoded value, which must span all of data.
+func bdecode(data []byte) (interface{}, error) {
+	value, _, err := bdecodeWithSpans(data)
+	return value, err
+}
+
+func bdecodeWithSpans(data []byte) (interface{}, map[string][2]int, error) {
+	d := &bdecoder{data: data, spans: map[string][2]int{}}
+	value, err := d.decode(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, nil, fmt.Errorf("trailing data at offset %d", d.pos)
+	}
+	return value, d.spans, nil
+}
+
+func (d *bdecoder) decode(depth int) (interface{}, error) {
+	if depth > bencodeMaxDepth {
+		return nil, &BencodeError{Code: ERROR_DEPTH_EXCEEDED, Offset: d.pos}
+	}
+	if d.pos >= len(d.data) {
+		return nil, &BencodeError{Code: ERROR_UNEXPECTED_EOF, Offset: d.pos}
+	}
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		d.pos++
+		return d.decodeInt('e')
+	case c == 'l':
+		d.pos++
+		list := []interface{}{}
+		for {
+			if d.pos >= len(d.data) {
+				return nil, &BencodeError{Code: ERROR_UNEXPECTED_EOF, Offset: d.pos}
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return list, nil
+			}
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+	case c == 'd':
+		d.pos++
+		dict := map[string]interface{}{}
+		for {
+			if d.pos >= len(d.data) {
+				return nil, &BencodeError{Code: ERROR_UNEXPECTED_EOF, Offset: d.pos}
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return dict, nil
+			}
+			key, err := d.decodeString()
+			if err != nil {
+				return nil, err
+			}
+			start := d.pos
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if depth == 0 {
+				d.spans[key] = [2]int{start, d.pos}
+			}
+			dict[key] = value
+		}
+	case c >= '0' && c <= '9':
+		return d.decodeString()
+	default:
+		return nil, &BencodeError{Code: ERROR_EXPECTED_VALUE, Offset: d.pos}
+	}
+}
+
+// decodeInt reads an integer up to end.
+func (d *bdecoder) decodeInt(end byte) (int64, error) {
+	start := d.pos
+	for d.pos < len(d.data) && d.data[d.pos] != end {
+		c := d.data[d.pos]
+		if (c < '0' || c > '9') && !(c == '-' && d.pos == start) {
+			if end == ':' {
+				return 0, &BencodeError{Code: ERROR_EXPECTED_COLON, Offset: d.pos}
+			}
+			return 0, &BencodeError{Code: ERROR_EXPECTED_DIGID, Offset: d.pos}
+		}
+		d.pos++
+	}
+	if d.pos >= len(d.data) {
+		return 0, &BencodeError{Code: ERROR_UNEXPECTED_EOF, Offset: d.pos}
+	}
+	if d.pos == start {
+		return 0, &BencodeError{Code: ERROR_EXPECTED_DIGID, Offset: d.pos}
+	}
+	value, err := strconv.ParseInt(string(d.data[start:d.pos]), 10, 64)
+	if err != nil {
+		return 0, &BencodeError{Code: ERROR_OVERFLOW, Offset: start}
+	}
+	d.pos++
+	return value, nil
+}
+
+func (d *bdecoder) decodeString() (string, error) {
+	if d.pos >= len(d.data) || d.data[d.pos] < '0' || d.data[d.pos] > '9' {
+		return "", &BencodeError{Code: ERROR_EXPECTED_DIGID, Offset: d.pos}
+	}
+	length, err := d.decodeInt(':')
+	if err != nil {
+		return "", err
+	}
+	if length < 0 || length > int64(len(d.data)-d.pos) {
+		return "", &BencodeError{Code: ERROR_UNEXPECTED_EOF, Offset: d.pos}
+	}
+	value := string(d.data[d.pos : d.pos+int(length)])
+	d.pos += int(length)
+	return value, nil
+}
+
+// bencode encodes int, int64, string, []byte, []interface{}, []string and
+// map[string]interface{} values, with sorted dictionary keys.
+func bencode(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencodeTo(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func bencodeTo(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case bool:
+		if v {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buf, "%d:", len(v))
+		buf.Write(v)
+	case []string:
+		buf.WriteByte('l')
+		for _, item := range v {
+			fmt.Fprintf(buf, "%d:%s", len(item), item)
+		}
+		buf.WriteByte('e')
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, item := range v {
+			if err := bencodeTo(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, key := range keys {
+			fmt.Fprintf(buf, "%d:%s", len(key), key)
+			if err := bencodeTo(buf, v[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("unable to bencode %T", value)
+	}
+	return nil
+}
+
+// bdecodeFile decodes a bencoded file, which must be a dictionary. It
+// also returns the info-hash, if the file holds an info dictionary.
+func bdecodeFile(path string) (map[string]interface{}, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return bdecodeDict(data)
+}
+
+func bdecodeDict(data []byte) (map[string]interface{}, string, error) {
+	value, spans, err := bdecodeWithSpans(data)
+	if err != nil {
+		return nil, "", err
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, "", fmt.Errorf("not a bencoded dictionary")
+	}
+	infoHash := ""
+	if span, ok := spans["info"]; ok {
+		sum := sha1.Sum(data[span[0]:span[1]])
+		infoHash = hex.EncodeToString(sum[:])
+	}
+	return dict, infoHash, nil
+}
+
+// validateTorrentFile checks that path is a bencoded .torrent with an info
+// dictionary, before it is handed to libtorrent. The caller names the
+// file in the error, path may be a temporary file.
+func validateTorrentFile(path string) error {
+	dict, _, err := bdecodeFile(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := dict["info"].(map[string]interface{}); !ok {
+		return errors.New("no info dictionary")
+	}
+	return nil
+}
+
+// bencodeString, bencodeInt, bencodeList and bencodeDictValue read
+// optional values of a decoded dictionary.
+func bencodeString(dict map[string]interface{}, key string) string {
+	s, _ := dict[key].(string)
+	return s
+}
+
+func bencodeInt(dict map[string]interface{}, key string) int64 {
+	i, _ := dict[key].(int64)
+	return i
+}
+
+func bencodeList(dict map[string]interface{}, key string) []interface{} {
+	l, _ := dict[key].([]interface{})
+	return l
+}
+
+func bencodeDictValue(dict map[string]interface{}, key string) map[string]interface{} {
+	d, _ := dict[key].(map[string]interface{})
+	return d
+}
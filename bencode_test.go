@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPieces is the "pieces" string of the test torrents: bytes 0 to 19.
+const testPieces = "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"
+
+func TestBdecodeMalformed(t *testing.T) {
+	tests := []struct {
+		data string
+		code int
+	}{
+		{"", ERROR_UNEXPECTED_EOF},
+		{"x", ERROR_EXPECTED_VALUE},
+		{"i12", ERROR_UNEXPECTED_EOF},
+		{"ie", ERROR_EXPECTED_DIGID},
+		{"i1x2e", ERROR_EXPECTED_DIGID},
+		{"i99999999999999999999e", ERROR_OVERFLOW},
+		{"5:abc", ERROR_UNEXPECTED_EOF},
+		{"3x:abc", ERROR_EXPECTED_COLON},
+		{"l1:a", ERROR_UNEXPECTED_EOF},
+		{"d1:a", ERROR_UNEXPECTED_EOF},
+		{"di1ei2ee", ERROR_EXPECTED_DIGID},
+	}
+	for _, test := range tests {
+		_, err := bdecode([]byte(test.data))
+		bencodeErr, ok := err.(*BencodeError)
+		if !ok {
+			t.Errorf("bdecode(%q): got error %v, want a BencodeError", test.data, err)
+			continue
+		}
+		if bencodeErr.Code != test.code {
+			t.Errorf("bdecode(%q): got %q, want %q", test.data, err, errorStrings[test.code])
+		}
+	}
+}
+
+func TestBdecodeTrailingData(t *testing.T) {
+	if _, err := bdecode([]byte("i1ei2e")); err == nil {
+		t.Error("bdecode(\"i1ei2e\"): got no error")
+	}
+}
+
+func TestBdecodeDepthLimit(t *testing.T) {
+	tests := []struct {
+		depth int
+		ok    bool
+	}{
+		{1, true},
+		{bencodeMaxDepth, true},
+		{bencodeMaxDepth + 1, true},
+		{bencodeMaxDepth + 2, false},
+		{100000, false},
+	}
+	for _, test := range tests {
+		data := strings.Repeat("l", test.depth) + strings.Repeat("e", test.depth)
+		_, err := bdecode([]byte(data))
+		if test.ok && err != nil {
+			t.Errorf("%d nested lists: got %v", test.depth, err)
+		}
+		if !test.ok {
+			if bencodeErr, ok := err.(*BencodeError); !ok || bencodeErr.Code != ERROR_DEPTH_EXCEEDED {
+				t.Errorf("%d nested lists: got %v, want %q", test.depth, err, errorStrings[ERROR_DEPTH_EXCEEDED])
+			}
+		}
+	}
+}
+
+func TestBencodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		data  string
+	}{
+		{int64(0), "i0e"},
+		{int64(-42), "i-42e"},
+		{"", "0:"},
+		{"spam", "4:spam"},
+		{[]interface{}{}, "le"},
+		{[]interface{}{"a", int64(1)}, "l1:ai1ee"},
+		{map[string]interface{}{}, "de"},
+		{map[string]interface{}{"b": int64(2), "a": []interface{}{"x"}}, "d1:al1:xe1:bi2ee"},
+	}
+	for _, test := range tests {
+		data, err := bencode(test.value)
+		if err != nil {
+			t.Errorf("bencode(%#v): %s", test.value, err)
+			continue
+		}
+		if string(data) != test.data {
+			t.Errorf("bencode(%#v) = %q, want %q", test.value, data, test.data)
+		}
+		value, err := bdecode(data)
+		if err != nil {
+			t.Errorf("bdecode(%q): %s", data, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, test.value) {
+			t.Errorf("bdecode(%q) = %#v, want %#v", data, value, test.value)
+		}
+	}
+}
+
+func TestBdecodeDictInfoHash(t *testing.T) {
+	tests := []struct {
+		data     string
+		infoHash string
+	}{
+		{
+			"d8:announce15:http://tracker/4:infod6:lengthi12345e4:name8:test.bin12:piece lengthi16384e6:pieces20:" + testPieces + "ee",
+			"eab8fb63830d5e5408549f90d750d5d82cd1689e",
+		},
+		// the info dictionary is hashed as it is in the file, even with
+		// unsorted keys
+		{
+			"d4:infod4:name8:test.bin6:lengthi12345e12:piece lengthi16384e6:pieces20:" + testPieces + "ee",
+			"7a4a8d77f48314a7143f6292af936a3f39f117ef",
+		},
+		{"d8:announce15:http://tracker/e", ""},
+	}
+	for _, test := range tests {
+		_, infoHash, err := bdecodeDict([]byte(test.data))
+		if err != nil {
+			t.Errorf("bdecodeDict(%q): %s", test.data, err)
+			continue
+		}
+		if infoHash != test.infoHash {
+			t.Errorf("bdecodeDict(%q): info-hash %s, want %s", test.data, infoHash, test.infoHash)
+		}
+	}
+	if _, _, err := bdecodeDict([]byte("l4:infoe")); err == nil {
+		t.Error("bdecodeDict of a list: got no error")
+	}
+}
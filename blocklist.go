@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// datMaxBlockedLevel is the highest ipfilter.dat access level that
+// means "blocked", as in eMule.
+const datMaxBlockedLevel = 127
+
+var (
+	blocklistLock     sync.Mutex
+	blocklistError    string
+	blocklistLoadedAt time.Time
+	// blockedPeers counts peer_blocked_alert notifications.
+	blockedPeers int64
+)
+
+type BlocklistInfo struct {
+	Source       string `json:"source"`
+	Rules        int    `json:"rules"`
+	BlockedPeers int64  `json:"blocked_peers"`
+	LoadedAt     int64  `json:"loaded_at"`
+	Error        string `json:"error"`
+}
+
+// readBlocklist reads -blocklist from disk or over HTTP, transparently
+// decompressing gzip.
+func readBlocklist(source string) ([]byte, error) {
+	var data []byte
+	if u, err := url.Parse(source); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		client := newHTTPClient()
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %s", source, resp.Status)
+		}
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		if data, err = ioutil.ReadFile(source); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+	return data, nil
+}
+
+// parseBlocklist parses PeerGuardian .p2p ("desc:first-last"), eMule
+// ipfilter.dat ("first - last , level , desc") and plain address/CIDR
+// lines, which may be mixed. Unparseable lines are counted and skipped.
+func parseBlocklist(r io.Reader) ([]IPRange, int) {
+	var ranges []IPRange
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		ipRange, ok := parseBlocklistLine(line)
+		if !ok {
+			skipped++
+			continue
+		}
+		ranges = append(ranges, ipRange)
+	}
+	return ranges, skipped
+}
+
+func parseBlocklistLine(line string) (IPRange, bool) {
+	// ipfilter.dat
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err == nil {
+			if level > datMaxBlockedLevel {
+				return IPRange{}, false
+			}
+			ipRange, err := parseIPRange(trimOctetZeros(fields[0]))
+			return ipRange, err == nil
+		}
+	}
+	// .p2p, the description may itself contain colons
+	if i := strings.LastIndex(line, ":"); i >= 0 && strings.Contains(line[i:], "-") {
+		ipRange, err := parseIPRange(trimOctetZeros(line[i+1:]))
+		return ipRange, err == nil
+	}
+	ipRange, err := parseIPRange(line)
+	return ipRange, err == nil
+}
+
+// trimOctetZeros turns "001.002.003.004" into "1.2.3.4", which net.ParseIP
+// rejects otherwise. IPv6 addresses are left alone.
+func trimOctetZeros(s string) string {
+	if strings.Contains(s, ":") {
+		return s
+	}
+	var out bytes.Buffer
+	start := true
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		isDigit := c >= '0' && c <= '9'
+		if start && c == '0' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9' {
+			continue
+		}
+		start = !isDigit
+		out.WriteByte(c)
+	}
+	return out.String()
+}
+
+// loadBlocklist (re)loads -blocklist and installs it in the session IP
+// filter. On failure the previous list stays in effect.
+func loadBlocklist() error {
+	blocklistLock.Lock()
+	defer blocklistLock.Unlock()
+
+	log.Printf("loading blocklist: %s", config.blocklist)
+	data, err := readBlocklist(config.blocklist)
+	if err == nil {
+		ranges, skipped := parseBlocklist(bytes.NewReader(data))
+		if len(ranges) == 0 {
+			err = fmt.Errorf("no rules found in %s", config.blocklist)
+		} else {
+			log.Printf("blocklist loaded: %d rule(s), %d line(s) skipped", len(ranges), skipped)
+			ipFilterLock.Lock()
+			blocklistRanges = ranges
+			ipFilterLock.Unlock()
+			blocklistLoadedAt = time.Now()
+			applyIPFilter()
+		}
+	}
+	if err != nil {
+		log.Printf("unable to load blocklist: %s", err)
+		blocklistError = err.Error()
+		return err
+	}
+	blocklistError = ""
+	return nil
+}
+
+// refreshBlocklist loads -blocklist and reloads it every
+// -blocklist-refresh hours.
+func refreshBlocklist() {
+	for {
+		loadBlocklist()
+		if config.blocklistRefresh <= 0 {
+			return
+		}
+		time.Sleep(time.Duration(config.blocklistRefresh) * time.Hour)
+	}
+}
+
+func getBlocklistInfo() BlocklistInfo {
+	blocklistLock.Lock()
+	defer blocklistLock.Unlock()
+	ipFilterLock.Lock()
+	defer ipFilterLock.Unlock()
+
+	info := BlocklistInfo{
+		Source:       config.blocklist,
+		Rules:        len(blocklistRanges),
+		BlockedPeers: atomic.LoadInt64(&blockedPeers),
+		Error:        blocklistError,
+	}
+	if !blocklistLoadedAt.IsZero() {
+		info.LoadedAt = blocklistLoadedAt.Unix()
+	}
+	return info
+}
+
+// blocklistHandler shows the blocklist state; POST reloads it first.
+func blocklistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		if config.blocklist == "" {
+			http.Error(w, "no -blocklist configured", http.StatusBadRequest)
+			return
+		}
+		loadBlocklist()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	output, _ := json.Marshal(getBlocklistInfo())
+	w.Write(output)
+}
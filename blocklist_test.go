@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBlocklistLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		first string
+		last  string
+		ok    bool
+	}{
+		// PeerGuardian .p2p
+		{"Some Org:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255", true},
+		{"desc: with: colons:10.0.0.1-10.0.0.2", "10.0.0.1", "10.0.0.2", true},
+		// eMule ipfilter.dat
+		{"001.002.003.000 - 001.002.003.255 , 000 , Some Org", "1.2.3.0", "1.2.3.255", true},
+		{"001.002.003.000 - 001.002.003.255 , 127 , Some Org", "1.2.3.0", "1.2.3.255", true},
+		{"001.002.003.000 - 001.002.003.255 , 128 , allowed", "", "", false},
+		// addresses and CIDR blocks
+		{"192.168.1.1", "192.168.1.1", "192.168.1.1", true},
+		{"10.0.0.0/8", "10.0.0.0", "10.255.255.255", true},
+		{"2001:db8::/32", "2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{"1.2.3.4-1.2.3.1", "", "", false},
+		{"1.2.3.4-::1", "", "", false},
+		{"garbage", "", "", false},
+	}
+	for _, test := range tests {
+		ipRange, ok := parseBlocklistLine(test.line)
+		if ok != test.ok {
+			t.Errorf("parseBlocklistLine(%q): ok = %v, want %v", test.line, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if ipRange.First.String() != test.first || ipRange.Last.String() != test.last {
+			t.Errorf("parseBlocklistLine(%q) = %s-%s, want %s-%s", test.line, ipRange.First, ipRange.Last, test.first, test.last)
+		}
+	}
+}
+
+func TestParseBlocklist(t *testing.T) {
+	list := `# comment
+// another comment
+
+Some Org:1.2.3.0-1.2.3.255
+005.006.007.008 - 005.006.007.009 , 100 , Other Org
+not an address
+10.0.0.0/8
+`
+	ranges, skipped := parseBlocklist(strings.NewReader(list))
+	if len(ranges) != 3 || skipped != 1 {
+		t.Errorf("parseBlocklist: got %d ranges and %d skipped lines, want 3 and 1", len(ranges), skipped)
+	}
+}
+
+func TestTrimOctetZeros(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"001.002.003.004", "1.2.3.4"},
+		{"000.010.100.000", "0.10.100.0"},
+		{"1.2.3.4 - 005.006.007.008", "1.2.3.4 - 5.6.7.8"},
+		{"2001:db8::01", "2001:db8::01"},
+	}
+	for _, test := range tests {
+		if got := trimOctetZeros(test.s); got != test.want {
+			t.Errorf("trimOctetZeros(%q) = %q, want %q", test.s, got, test.want)
+		}
+	}
+}
+
+func TestIPRangeOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		overlaps bool
+	}{
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.1-10.0.0.5", "10.0.0.5-10.0.0.9", true},
+		{"10.0.0.1-10.0.0.5", "10.0.0.6-10.0.0.9", false},
+		{"10.0.0.0/8", "11.0.0.1", false},
+		{"::/0", "10.0.0.1", false},
+	}
+	for _, test := range tests {
+		a, _ := parseIPRange(test.a)
+		b, _ := parseIPRange(test.b)
+		if got := a.Overlaps(b); got != test.overlaps {
+			t.Errorf("%s.Overlaps(%s) = %v, want %v", test.a, test.b, got, test.overlaps)
+		}
+		if got := b.Overlaps(a); got != test.overlaps {
+			t.Errorf("%s.Overlaps(%s) = %v, want %v", test.b, test.a, got, test.overlaps)
+		}
+	}
+}
@@ -16,6 +16,7 @@ type Config struct {
     connectionsLimit        int
     downloadPath            string
     resumeFile              string
+    resumeDir               string
     stateFile               string
     userAgent               string
     keepComplete            bool
@@ -54,11 +55,57 @@ type Config struct {
     prioritizePartialPieces bool
     strictEndGameMode       bool
     subsFirst               bool
+    metadataCache           string
+    metadataCacheSize       int
+    metadataCachePolicy     string
+    fetchHeaders            stringsFlag
+    fetchCookies            string
+    fetchTimeout            int
+    fetchRetries            int
+    fetchMaxSize            int
+    watchDir                string
+    watchInterval           int
+    defaultTrackers         bool
+    trackersFile            string
+    trackersURL             string
+    trackersRefresh         int
+    blocklist               string
+    blocklistRefresh        int
+    geoIPDB                 string
+    proxy                   string
+    proxyPeers              bool
+    proxyTrackers           bool
+    proxyHostnames          bool
+    listenInterfaces        string
+    outgoingInterface       string
+    killSwitch              bool
+    listenPorts             string
+    portMode                string
+    portFile                string
+    stateInterval           int
+    seedRatio               float64
+    seedTime                int
+    seedWhileStreaming      bool
+    seedStopAfter           int
+    seedAction              string
+    bandwidthSchedule       string
+    streamThrottleRate      int
+    streamBuffer            int
+    maxDiskUsage            int
+    incompletePath          string
+    moveTemplate            string
+    organizeDir             string
+    organizeMode            string
+    organizeMovieTemplate   string
+    organizeTVTemplate      string
+    sanitizeNames           bool
+    createRoot              string
+    moveRoot                string
 }
 
 func (c Config) parseFlags() {
     config = Config{}
-    flag.StringVar(&config.uri, "uri", "", "Magnet URI or .torrent file URL")
+    flag.StringVar(&config.uri, "uri", "", "Magnet URI, info-hash or .torrent file URL")
     flag.StringVar(&config.bindAddress, "bind", "localhost:5001", "Bind address of torrent2http")
     flag.StringVar(&config.downloadPath, "dl-path", ".", "Download path")
     flag.IntVar(&config.idleTimeout, "max-idle", -1, "Automatically shutdown if no connection are active after a timeout")
@@ -78,6 +125,53 @@ func (c Config) parseFlags() {
     flag.StringVar(&config.userAgent, "user-agent", UserAgent(), "Set an user agent")
     flag.StringVar(&config.dhtRouters, "dht-routers", "", "Additional DHT routers (comma-separated host:port pairs)")
     flag.StringVar(&config.trackers, "trackers", "", "Additional trackers (comma-separated URLs)")
+    flag.Var(&config.fetchHeaders, "fetch-header", "Extra HTTP header for fetching .torrent files, as \"Name: value\" (can be repeated)")
+    flag.StringVar(&config.fetchCookies, "fetch-cookies", "", "Cookies file (Netscape cookies.txt format) for fetching .torrent files")
+    flag.IntVar(&config.fetchTimeout, "fetch-timeout", 30, "Timeout for fetching .torrent files (seconds)")
+    flag.IntVar(&config.fetchRetries, "fetch-retries", 3, "Number of retries with backoff when fetching .torrent files fails")
+    flag.IntVar(&config.fetchMaxSize, "fetch-max-size", 10, "Max size of fetched .torrent files (MB)")
+    flag.StringVar(&config.watchDir, "watch-dir", "", "Add .torrent and .magnet files dropped into this folder")
+    flag.IntVar(&config.watchInterval, "watch-interval", 5, "Interval between scans of -watch-dir (seconds)")
+    flag.BoolVar(&config.defaultTrackers, "default-trackers", false, "Add the built-in list of public trackers")
+    flag.StringVar(&config.trackersFile, "trackers-file", "", "Add trackers from a file (one URL per line)")
+    flag.StringVar(&config.trackersURL, "trackers-url", "", "Add trackers from a list served over HTTP (one URL per line)")
+    flag.IntVar(&config.trackersRefresh, "trackers-refresh", 60, "Interval between reloads of -trackers-file/-trackers-url (minutes), 0=load once")
+    flag.StringVar(&config.blocklist, "blocklist", "", "IP blocklist file or URL (PeerGuardian .p2p, eMule ipfilter.dat or CIDR list, optionally gzipped)")
+    flag.IntVar(&config.blocklistRefresh, "blocklist-refresh", 24, "Interval between reloads of -blocklist (hours), 0=load once")
+    flag.StringVar(&config.geoIPDB, "geoip-db", "", "MaxMind-format .mmdb database(s) for peer country and ASN lookup (comma-separated)")
+    flag.StringVar(&config.proxy, "proxy", "", "Proxy URL: socks4://host:port, socks5://[user:pass@]host:port, http://[user:pass@]host:port or i2p://host:port (SAM bridge)")
+    flag.BoolVar(&config.proxyPeers, "proxy-peers", true, "Connect to peers through -proxy")
+    flag.BoolVar(&config.proxyTrackers, "proxy-trackers", true, "Connect to trackers (and fetch .torrent files) through -proxy. With socks4 and i2p proxies, downloads made by torrent2http itself fail instead of connecting directly")
+    flag.BoolVar(&config.proxyHostnames, "proxy-hostnames", true, "Resolve hostnames through -proxy")
+    flag.StringVar(&config.listenInterfaces, "listen-interfaces", "0.0.0.0,::", "Interfaces to listen on (comma-separated interface names or IPv4/IPv6 addresses)")
+    flag.StringVar(&config.outgoingInterface, "outgoing-interface", "", "Interface(s) for outgoing connections (comma-separated interface names or addresses)")
+    flag.BoolVar(&config.killSwitch, "kill-switch", false, "Pause the session while a bound interface (e.g. a VPN) is down")
+    flag.StringVar(&config.listenPorts, "listen-ports", "", "Port range for incoming connections, e.g. 6881-6889 (overrides -listen-port and -random-port)")
+    flag.StringVar(&config.portMode, "port-mode", "random", "How to pick the listen port from the range: random or first-free")
+    flag.StringVar(&config.portFile, "port-file", "", "File to remember the chosen listen port across restarts")
+    flag.IntVar(&config.stateInterval, "state-interval", 10, "Save -state-file every N minutes (0=only on exit)")
+    flag.Float64Var(&config.seedRatio, "seed-ratio", 0, "Stop seeding when the share ratio reaches this value (0=no limit)")
+    flag.IntVar(&config.seedTime, "seed-time", 0, "Seed for at least N minutes (alone: stop seeding after N minutes)")
+    flag.BoolVar(&config.seedWhileStreaming, "seed-while-streaming", false, "Seed only while a file is being streamed from /files/")
+    flag.IntVar(&config.seedStopAfter, "seed-stop-after", -1, "Stop seeding N minutes after the last /files/ reader disconnects (-1=disabled)")
+    flag.StringVar(&config.seedAction, "seed-action", "pause", "What to do when the seeding goal is reached: pause, remove or exit")
+    flag.StringVar(&config.bandwidthSchedule, "bandwidth-schedule", "", "Rate limit schedule, e.g. \"mon-fri 08:00-18:00 ul 50; daily 00:00-06:00 dl unlimited\" (kB/s, outside the rules -dl-rate/-ul-rate apply)")
+    flag.IntVar(&config.streamThrottleRate, "stream-throttle-rate", -1, "Cut the upload rate to this value (kB/s) while a stream is waiting for pieces (-1=disabled)")
+    flag.IntVar(&config.streamBuffer, "stream-buffer", 5, "Pieces ahead of the read position a stream needs before the upload rate is restored")
+    flag.IntVar(&config.maxDiskUsage, "max-disk-usage", 0, "Max size of -dl-path (MB), least recently streamed kept torrents are evicted (0=unlimited)")
+    flag.StringVar(&config.incompletePath, "incomplete-path", "", "Download path for unfinished torrents, moved to -dl-path when finished")
+    flag.StringVar(&config.moveTemplate, "move-template", "", "Directory under -dl-path for finished torrents, with {name} and {hash} placeholders, or path of each completed file with {file}")
+    flag.StringVar(&config.organizeDir, "organize-dir", "", "Library directory to sort completed videos and their subtitles into")
+    flag.StringVar(&config.organizeMode, "organize-mode", "hardlink", "How to put files into -organize-dir: hardlink or move")
+    flag.StringVar(&config.organizeMovieTemplate, "organize-movie-template", "Movies/{title} ({year})/{title} ({year}){ext}", "Path of movies under -organize-dir")
+    flag.StringVar(&config.organizeTVTemplate, "organize-tv-template", "TV/{title}/Season {season}/{title} S{season}E{episode}{ext}", "Path of episodes under -organize-dir")
+    flag.StringVar(&config.createRoot, "create-root", "", "Directory /create may make torrents from (default: -dl-path)")
+    flag.StringVar(&config.moveRoot, "move-root", "", "Directory /move may move the torrent into (default: -dl-path)")
+    flag.BoolVar(&config.sanitizeNames, "sanitize-names", false, "Rename files with characters unsafe for players or filesystems when metadata is received")
+    flag.StringVar(&config.resumeDir, "resume-dir", ".torrent2http-resume", "Directory for the resume data of each torrent (<info-hash>.fastresume) when -resume-file is not set, relative to -dl-path; empty to disable")
+    flag.StringVar(&config.metadataCache, "metadata-cache", "", "Directory for caching torrent metadata by info-hash")
+    flag.IntVar(&config.metadataCacheSize, "metadata-cache-size", 50, "Max size of the metadata cache (MB), 0=unlimited")
+    flag.StringVar(&config.metadataCachePolicy, "metadata-cache-policy", "lru", "Metadata cache eviction policy: lru or fifo")
     flag.IntVar(&config.listenPort, "listen-port", 6881, "Use specified port for incoming connections")
     flag.IntVar(&config.torrentConnectBoost, "torrent-connect-boost", 50, "The number of peers to try to connect to immediately when the first tracker response is received for a torrent")
     flag.IntVar(&config.connectionSpeed, "connection-speed", 250, "The number of peer connection attempts that are made per second")
@@ -122,6 +216,57 @@ func (c Config) parseFlags() {
         fmt.Println("Usage of option -resume-file is allowed only along with -keep-files")
         os.Exit(1)
     }
+    if len(listenHosts()) == 0 {
+        fmt.Println("Option -listen-interfaces must not be empty")
+        os.Exit(1)
+    }
+    if config.listenPorts != "" {
+        if _, _, err := parsePortRange(config.listenPorts); err != nil {
+            fmt.Printf("Invalid -listen-ports: %s\n", err)
+            os.Exit(1)
+        }
+    }
+    if config.portMode != "random" && config.portMode != "first-free" {
+        fmt.Println("Option -port-mode must be one of: random, first-free")
+        os.Exit(1)
+    }
+    if config.seedAction != "pause" && config.seedAction != "remove" && config.seedAction != "exit" {
+        fmt.Println("Option -seed-action must be one of: pause, remove, exit")
+        os.Exit(1)
+    }
+    if config.bandwidthSchedule != "" {
+        var err error
+        if bandwidthSchedule, err = parseSchedule(config.bandwidthSchedule); err != nil {
+            fmt.Printf("Invalid -bandwidth-schedule: %s\n", err)
+            os.Exit(1)
+        }
+    }
+    if config.organizeMode != "hardlink" && config.organizeMode != "move" {
+        fmt.Println("Option -organize-mode must be one of: hardlink, move")
+        os.Exit(1)
+    }
+    if config.organizeDir != "" && config.organizeMode == "move" && !config.keepFiles && !config.keepComplete {
+        fmt.Println("Option -organize-mode move is allowed only along with -keep-files or -keep-complete")
+        os.Exit(1)
+    }
+    if config.proxy != "" {
+        var err error
+        if proxyConfig, err = parseProxy(config.proxy); err != nil {
+            fmt.Printf("Invalid -proxy: %s\n", err)
+            os.Exit(1)
+        }
+    }
+    if config.metadataCachePolicy != "lru" && config.metadataCachePolicy != "fifo" {
+        fmt.Println("Option -metadata-cache-policy must be one of: lru, fifo")
+        os.Exit(1)
+    }
+    // the roots stay the initial -dl-path when /move changes it
+    if config.createRoot == "" {
+        config.createRoot = config.downloadPath
+    }
+    if config.moveRoot == "" {
+        config.moveRoot = config.downloadPath
+    }
 }
 
 //Returns the command line for a given process name
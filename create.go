@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+const (
+	minPieceSize = 16 * 1024
+	maxPieceSize = 16 * 1024 * 1024
+	// targetPieces is the number of pieces the automatic piece size aims
+	// for.
+	targetPieces = 1500
+)
+
+// CreateOptions are the options of "torrent2http create" and /create.
+type CreateOptions struct {
+	Path      string
+	PieceSize int64
+	Trackers  []string
+	WebSeeds  []string
+	Private   bool
+	Comment   string
+}
+
+// CreatedTorrent is the answer of /create.
+type CreatedTorrent struct {
+	Name        string `json:"name"`
+	InfoHash    string `json:"info_hash"`
+	TorrentFile string `json:"torrent_file"`
+	Magnet      string `json:"magnet"`
+	SavePath    string `json:"save_path"`
+	Size        int64  `json:"size"`
+	PieceSize   int64  `json:"piece_size"`
+	NumPieces   int    `json:"num_pieces"`
+}
+
+var (
+	createdTorrentsLock sync.Mutex
+	// createdTorrents holds the info-hashes of the torrents seeded by
+	// /create, whose data stays where it is.
+	createdTorrents = map[string]bool{}
+)
+
+// autoPieceSize picks a power of two piece size giving about
+// targetPieces pieces.
+func autoPieceSize(totalSize int64) int64 {
+	size := int64(minPieceSize)
+	for size < maxPieceSize && totalSize/size > targetPieces {
+		size *= 2
+	}
+	return size
+}
+
+// contentFiles lists the files of path, a file or a directory, in the
+// order they go in the torrent.
+func contentFiles(root string) ([]InspectFile, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []InspectFile{{Path: filepath.Base(root), Size: info.Size()}}, nil
+	}
+	var files []InspectFile
+	var offset int64
+	err = filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(filepath.Dir(root), filePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, InspectFile{Path: filepath.ToSlash(relPath), Size: info.Size(), Offset: offset})
+		offset += info.Size()
+		return nil
+	})
+	if err == nil && len(files) == 0 {
+		err = errors.New("no files in " + root)
+	}
+	return files, err
+}
+
+// hashPieces computes the piece hashes of files, read from dir.
+func hashPieces(dir string, files []InspectFile, pieceSize int64) ([]byte, error) {
+	var pieces []byte
+	piece := make([]byte, 0, pieceSize)
+	hashPiece := func() {
+		sum := sha1.Sum(piece)
+		pieces = append(pieces, sum[:]...)
+		piece = piece[:0]
+	}
+	for _, file := range files {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file.Path)))
+		if err != nil {
+			return nil, err
+		}
+		var read int64
+		for {
+			n, err := f.Read(piece[len(piece):pieceSize])
+			piece = piece[:len(piece)+n]
+			read += int64(n)
+			if int64(len(piece)) == pieceSize {
+				hashPiece()
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+		f.Close()
+		if read != file.Size {
+			return nil, fmt.Errorf("%s changed while hashing", file.Path)
+		}
+	}
+	if len(piece) > 0 {
+		hashPiece()
+	}
+	return pieces, nil
+}
+
+// createTorrent hashes opts.Path and returns the bencoded .torrent.
+func createTorrent(opts CreateOptions) ([]byte, *TorrentMeta, error) {
+	root, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := contentFiles(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	var totalSize int64
+	for _, file := range files {
+		totalSize += file.Size
+	}
+	pieceSize := opts.PieceSize
+	if pieceSize <= 0 {
+		pieceSize = autoPieceSize(totalSize)
+	}
+	if pieceSize < minPieceSize || pieceSize > maxPieceSize || pieceSize&(pieceSize-1) != 0 {
+		return nil, nil, fmt.Errorf("piece size must be a power of two between %d kB and %d kB", minPieceSize/1024, maxPieceSize/1024)
+	}
+	log.Printf("hashing %s (%d file(s), %d bytes, %d kB pieces)", root, len(files), totalSize, pieceSize/1024)
+	pieces, err := hashPieces(filepath.Dir(root), files, pieceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	name := filepath.Base(root)
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceSize,
+		"pieces":       pieces,
+	}
+	if fileInfo, _ := os.Stat(root); fileInfo.IsDir() {
+		var list []interface{}
+		for _, file := range files {
+			var parts []interface{}
+			for _, part := range strings.Split(file.Path, "/")[1:] {
+				parts = append(parts, part)
+			}
+			list = append(list, map[string]interface{}{"length": file.Size, "path": parts})
+		}
+		info["files"] = list
+	} else {
+		info["length"] = totalSize
+	}
+	if opts.Private {
+		info["private"] = 1
+	}
+
+	torrent := map[string]interface{}{
+		"info":          info,
+		"created by":    "torrent2http/" + Version,
+		"creation date": time.Now().Unix(),
+	}
+	if len(opts.Trackers) > 0 {
+		torrent["announce"] = opts.Trackers[0]
+		var tiers []interface{}
+		for _, tracker := range opts.Trackers {
+			tiers = append(tiers, []interface{}{tracker})
+		}
+		torrent["announce-list"] = tiers
+	}
+	if len(opts.WebSeeds) > 0 {
+		torrent["url-list"] = opts.WebSeeds
+	}
+	if opts.Comment != "" {
+		torrent["comment"] = opts.Comment
+	}
+
+	data, err := bencode(torrent)
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, infoHash, err := bdecodeDict(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, err := parseTorrentMeta(dict, infoHash)
+	return data, meta, err
+}
+
+func magnetLink(meta *TorrentMeta) string {
+	magnet := "magnet:?xt=urn:btih:" + meta.InfoHash + "&dn=" + url.QueryEscape(meta.Name)
+	for _, tracker := range meta.Trackers {
+		magnet += "&tr=" + url.QueryEscape(tracker)
+	}
+	for _, seed := range meta.WebSeeds {
+		magnet += "&ws=" + url.QueryEscape(seed)
+	}
+	return magnet
+}
+
+// createCommand runs "torrent2http create <path>".
+func createCommand(args []string) int {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	output := flags.String("o", "", "Output .torrent file (default: <name>.torrent)")
+	pieceSize := flags.Int("piece-size", 0, "Piece size (kB), a power of two (0=automatic)")
+	trackers := flags.String("trackers", "", "Trackers (comma-separated)")
+	webSeeds := flags.String("web-seeds", "", "Web seeds (comma-separated)")
+	private := flags.Bool("private", false, "Private torrent (no DHT, PEX and LSD)")
+	comment := flags.String("comment", "", "Comment")
+	positional, err := parseSubcommandArgs(flags, args)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: torrent2http create <path> [-o <file.torrent>] [-piece-size <kB>] [-trackers <urls>] [-web-seeds <urls>] [-private] [-comment <text>]")
+		return 2
+	}
+
+	data, meta, err := createTorrent(CreateOptions{
+		Path:      positional[0],
+		PieceSize: int64(*pieceSize) * 1024,
+		Trackers:  splitList(*trackers),
+		WebSeeds:  splitList(*webSeeds),
+		Private:   *private,
+		Comment:   *comment,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *output == "" {
+		*output = meta.Name + ".torrent"
+	}
+	if err := ioutil.WriteFile(*output, data, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: %s (%d pieces of %s)\n", *output, meta.InfoHash, len(meta.Pieces), formatSize(meta.PieceLength))
+	fmt.Println(magnetLink(meta))
+	return 0
+}
+
+// seedCreatedTorrent adds the .torrent created for the data in savePath
+// to the session, which checks the data and seeds it.
+func seedCreatedTorrent(torrentFile string, savePath string, private bool) error {
+	// buildTorrentParams strips the leading slash again on windows
+	uriPath := filepath.ToSlash(torrentFile)
+	if !strings.HasPrefix(uriPath, "/") {
+		uriPath = "/" + uriPath
+	}
+	torrentParams, err := buildTorrentParams((&url.URL{Scheme: "file", Path: uriPath}).String(), "")
+	if err != nil {
+		return err
+	}
+	defer lt.DeleteAddTorrentParams(torrentParams)
+	torrentParams.SetSavePath(savePath)
+	if private {
+		// -trackers and the curated trackers must not leak a private torrent
+		_, err = session.AddTorrent(torrentParams)
+	} else {
+		_, err = addTorrentToSession(torrentParams, nil)
+	}
+	return err
+}
+
+func isCreatedTorrent(infoHash string) bool {
+	createdTorrentsLock.Lock()
+	defer createdTorrentsLock.Unlock()
+	return createdTorrents[infoHash]
+}
+
+// resolveCreatePath resolves the path of /create, relative to -create-root
+// unless absolute, and checks that it exists inside the root once
+// symlinks are resolved.
+func resolveCreatePath(name string) (string, error) {
+	resolved, err := resolveInRoot(config.createRoot, name)
+	if err != nil {
+		return "", err
+	}
+	if root, _ := resolveInRoot(config.createRoot, "."); resolved == root {
+		return "", fmt.Errorf("%s is -create-root itself", name)
+	}
+	if _, err := os.Stat(resolved); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// createHandler handles POST /create?path=<file or dir>, with the options
+// of the create subcommand. The path must be inside -create-root. The
+// .torrent is written to -dl-path and the data is seeded right away.
+func createHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("path") == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+	contentPath, err := resolveCreatePath(query.Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	pieceSize, _ := strconv.Atoi(query.Get("piece_size"))
+	private, _ := strconv.ParseBool(query.Get("private"))
+	opts := CreateOptions{
+		Path:      contentPath,
+		PieceSize: int64(pieceSize) * 1024,
+		Trackers:  splitList(query.Get("trackers")),
+		WebSeeds:  splitList(query.Get("web_seeds")),
+		Private:   private,
+		Comment:   query.Get("comment"),
+	}
+	data, meta, err := createTorrent(opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	torrentFile := filepath.Join(getDownloadPath(), sanitizePathComponent(meta.Name)+".torrent")
+	if err := writeFileAtomic(torrentFile, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	torrentFile, _ = filepath.Abs(torrentFile)
+	savePath := filepath.Dir(contentPath)
+
+	// the lock keeps two /create of the same data from both adding it
+	createdTorrentsLock.Lock()
+	if !activeInfoHashes()[meta.InfoHash] {
+		if err := seedCreatedTorrent(torrentFile, savePath, opts.Private); err != nil {
+			createdTorrentsLock.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		createdTorrents[meta.InfoHash] = true
+		log.Printf("seeding %s (%s) from %s", meta.Name, meta.InfoHash, savePath)
+		publishEvent("created", "%s (%s)", meta.Name, meta.InfoHash)
+	}
+	createdTorrentsLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	output, _ := json.Marshal(CreatedTorrent{
+		Name:        meta.Name,
+		InfoHash:    meta.InfoHash,
+		TorrentFile: torrentFile,
+		Magnet:      magnetLink(meta),
+		SavePath:    savePath,
+		Size:        meta.TotalSize,
+		PieceSize:   meta.PieceLength,
+		NumPieces:   len(meta.Pieces),
+	})
+	w.Write(output)
+}
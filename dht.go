@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+var (
+	dhtLock         sync.Mutex
+	dhtRouters      []string
+	dhtBootstrapped bool
+	dhtNodes        int
+	dhtReplacements int
+	// stateSavedAt is when -state-file was last saved.
+	stateSavedAt time.Time
+)
+
+type DhtInfo struct {
+	Enabled      bool     `json:"enabled"`
+	Running      bool     `json:"running"`
+	Bootstrapped bool     `json:"bootstrapped"`
+	Nodes        int      `json:"nodes"`
+	Replacements int      `json:"replacements"`
+	Torrents     int      `json:"torrents"`
+	Routers      []string `json:"routers"`
+	StateFile    string   `json:"state_file"`
+	StateSavedAt int64    `json:"state_saved_at"`
+}
+
+// initDHTRouters builds the router list from -dht-routers and the
+// built-in dhtBootstrapNodes.
+func initDHTRouters() {
+	dhtLock.Lock()
+	defer dhtLock.Unlock()
+	dhtRouters = append(splitList(config.dhtRouters), dhtBootstrapNodes...)
+}
+
+func getDHTRouters() []string {
+	dhtLock.Lock()
+	defer dhtLock.Unlock()
+	return append([]string{}, dhtRouters...)
+}
+
+// addDHTRouter adds a host:port router at runtime and makes libtorrent
+// bootstrap from it.
+func addDHTRouter(router string) error {
+	if _, _, err := net.SplitHostPort(router); err != nil {
+		return err
+	}
+	dhtLock.Lock()
+	for _, existing := range dhtRouters {
+		if existing == router {
+			dhtLock.Unlock()
+			return nil
+		}
+	}
+	dhtRouters = append(dhtRouters, router)
+	dhtLock.Unlock()
+
+	log.Printf("adding DHT router: %s", router)
+	updateSettings(func(settings lt.SettingsPack) {
+		// the current list, should another router be added meanwhile
+		settings.SetStr("dht_bootstrap_nodes", strings.Join(getDHTRouters(), ","))
+	})
+	return nil
+}
+
+// loadDHTState restores the routing table saved in -state-file, so that
+// the DHT doesn't have to bootstrap from the routers again. The settings
+// saved along with it are left alone, the command line sets them.
+func loadDHTState() {
+	data, err := ioutil.ReadFile(config.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("unable to read DHT state: %s", err)
+		}
+		return
+	}
+	log.Printf("loading DHT state from: %s", config.stateFile)
+	node := lt.NewBdecodeNode()
+	defer lt.DeleteBdecodeNode(node)
+	errorCode := lt.NewErrorCode()
+	defer lt.DeleteErrorCode(errorCode)
+	lt.Bdecode(string(data), node, errorCode)
+	if errorCode.Value() != 0 {
+		log.Printf("invalid DHT state in %s: %s", config.stateFile, errorCode.Message())
+		return
+	}
+	session.LoadState(node, uint(lt.WrappedSessionHandleSaveDhtState))
+}
+
+// saveSessionStatePeriodically saves -state-file every -state-interval
+// minutes, so that the DHT routing table survives a crash or kill.
+func saveSessionStatePeriodically() {
+	if config.stateInterval <= 0 {
+		return
+	}
+	for range time.Tick(time.Duration(config.stateInterval) * time.Minute) {
+		saveSessionState()
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to path and
+// renames it over path, so that a crash never leaves a truncated file.
+// The temporary file is unique, so concurrent writes of the same path
+// don't mix, the last rename wins.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		// or a crash right after the rename may leave an empty file
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// TempFile creates it 0600
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// onDHTStats records the routing table size reported by dht_stats_alert.
+func onDHTStats(alert lt.Alert) {
+	table := lt.SwigcptrDhtStatsAlert(alert.Swigcptr()).GetRoutingTable()
+	nodes, replacements := 0, 0
+	for i := 0; i < int(table.Size()); i++ {
+		bucket := table.Get(i)
+		nodes += bucket.GetNumNodes()
+		replacements += bucket.GetNumReplacements()
+	}
+	dhtLock.Lock()
+	dhtNodes = nodes
+	dhtReplacements = replacements
+	dhtLock.Unlock()
+}
+
+func onDHTBootstrap() {
+	dhtLock.Lock()
+	dhtBootstrapped = true
+	dhtLock.Unlock()
+	log.Println("DHT bootstrapped")
+}
+
+// announcedTorrents counts the torrents currently announced to the DHT.
+func announcedTorrents() int {
+	torrents := session.GetTorrents()
+	defer lt.DeleteStdVectorTorrentHandle(torrents)
+	count := 0
+	for i := 0; i < int(torrents.Size()); i++ {
+		status := torrents.Get(i).Status()
+		if status.GetAnnouncingToDht() {
+			count++
+		}
+		lt.DeleteTorrentStatus(status)
+	}
+	return count
+}
+
+// dhtHandler shows the DHT state; POST with router=host:port adds a
+// bootstrap router.
+func dhtHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		router := r.URL.Query().Get("router")
+		if router == "" {
+			http.Error(w, "router is required", http.StatusBadRequest)
+			return
+		}
+		if !config.enableDHT {
+			http.Error(w, "DHT is disabled", http.StatusBadRequest)
+			return
+		}
+		if err := addDHTRouter(router); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	// The counts come from the dht_stats_alert requested here, so they
+	// lag one request behind.
+	session.PostDhtStats()
+
+	dhtLock.Lock()
+	info := DhtInfo{
+		Enabled:      config.enableDHT,
+		Running:      session.IsDhtRunning(),
+		Bootstrapped: dhtBootstrapped,
+		Nodes:        dhtNodes,
+		Replacements: dhtReplacements,
+		Routers:      append([]string{}, dhtRouters...),
+		StateFile:    config.stateFile,
+	}
+	if !stateSavedAt.IsZero() {
+		info.StateSavedAt = stateSavedAt.Unix()
+	}
+	dhtLock.Unlock()
+	info.Torrents = announcedTorrents()
+
+	output, _ := json.Marshal(info)
+	w.Write(output)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestWriteFileAtomicConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torrent2http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	written := map[string]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		data := fmt.Sprintf("state %d", i)
+		written[data] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := writeFileAtomic(path, []byte(data)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !written[string(data)] {
+		t.Errorf("%s holds %q, a mix of the writes", path, data)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d file(s) left in %s, want only %s", len(files), dir, path)
+	}
+}
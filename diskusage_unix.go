@@ -0,0 +1,17 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// diskUsage is the space allocated to a file, in 512 bytes blocks as
+// st_blocks.
+func diskUsage(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Blocks) * 512
+	}
+	return info.Size()
+}
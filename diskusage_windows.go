@@ -0,0 +1,11 @@
+// +build windows
+
+package main
+
+import "os"
+
+// diskUsage is the size of a file; Windows doesn't report the space of
+// sparse files in FileInfo.
+func diskUsage(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxStreamEvents = 200
+
+// StreamEvent is a notable thing that happened in the session, kept so
+// clients can poll /events instead of scraping the log.
+type StreamEvent struct {
+	ID      int64  `json:"id"`
+	Time    int64  `json:"time"`
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type StreamEventsInfo struct {
+	Events []StreamEvent `json:"events"`
+}
+
+var (
+	streamEventsLock sync.Mutex
+	streamEvents     []StreamEvent
+	lastStreamEvent  int64
+)
+
+// publishEvent appends an event to the stream, dropping the oldest one
+// once there are more than maxStreamEvents.
+func publishEvent(eventType string, format string, v ...interface{}) {
+	streamEventsLock.Lock()
+	defer streamEventsLock.Unlock()
+
+	lastStreamEvent++
+	streamEvents = append(streamEvents, StreamEvent{
+		ID:      lastStreamEvent,
+		Time:    time.Now().Unix(),
+		Type:    eventType,
+		Message: fmt.Sprintf(format, v...),
+	})
+	if len(streamEvents) > maxStreamEvents {
+		streamEvents = streamEvents[len(streamEvents)-maxStreamEvents:]
+	}
+}
+
+// eventsHandler lists the events with an id greater than ?since=.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	ret := StreamEventsInfo{Events: []StreamEvent{}}
+
+	streamEventsLock.Lock()
+	for _, event := range streamEvents {
+		if event.ID > since {
+			ret.Events = append(ret.Events, event)
+		}
+	}
+	streamEventsLock.Unlock()
+
+	output, _ := json.Marshal(ret)
+	w.Write(output)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stringsFlag is a flag.Value that collects repeated occurrences of a flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+var (
+	fetchStateLock sync.Mutex
+	// fetchState describes the .torrent download in progress, for
+	// /status while the torrent isn't added yet.
+	fetchState string
+)
+
+func setFetchState(state string) {
+	fetchStateLock.Lock()
+	fetchState = state
+	fetchStateLock.Unlock()
+}
+
+func getFetchState() string {
+	fetchStateLock.Lock()
+	defer fetchStateLock.Unlock()
+	return fetchState
+}
+
+// fetchError is returned for failures that won't go away by retrying.
+type fetchError struct {
+	err error
+}
+
+func (e fetchError) Error() string {
+	return e.err.Error()
+}
+
+// newFetchClient builds the HTTP client used to download .torrent files,
+// with the cookie jar loaded from -fetch-cookies.
+func newFetchClient() (*http.Client, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	if config.fetchCookies != "" {
+		if err := loadCookies(jar, config.fetchCookies); err != nil {
+			return nil, fmt.Errorf("unable to load cookies from %s: %s", config.fetchCookies, err)
+		}
+	}
+	client := newHTTPClient()
+	client.Jar = jar
+	return client, nil
+}
+
+// newHTTPClient returns a client for downloads made by torrent2http
+// itself, honoring -fetch-timeout and -proxy.
+func newHTTPClient() *http.Client {
+	client := &http.Client{Timeout: time.Duration(config.fetchTimeout) * time.Second}
+	if transport := proxyTransport(); transport != nil {
+		client.Transport = transport
+	}
+	return client
+}
+
+// loadCookies reads a Netscape/Mozilla cookies.txt file into jar.
+func loadCookies(jar http.CookieJar, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		if httpOnly {
+			line = line[len("#HttpOnly_"):]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		domain := strings.TrimPrefix(fields[0], ".")
+		cookie := &http.Cookie{
+			Path:     fields[2],
+			Secure:   fields[3] == "TRUE",
+			HttpOnly: httpOnly,
+			Name:     fields[5],
+			Value:    fields[6],
+		}
+		// without a Domain the jar keeps the cookie for this host only
+		if fields[1] == "TRUE" {
+			cookie.Domain = domain
+		}
+		if expires, err := strconv.ParseInt(fields[4], 10, 64); err == nil && expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: domain, Path: cookie.Path}, []*http.Cookie{cookie})
+	}
+	return scanner.Err()
+}
+
+// fetchTorrent downloads a .torrent file over HTTP, retrying with
+// exponential backoff, and returns the path of a temporary copy.
+// The caller is responsible for removing it.
+func fetchTorrent(uri string) (string, error) {
+	client, err := newFetchClient()
+	if err != nil {
+		return "", err
+	}
+
+	defer setFetchState("")
+	var data []byte
+	backoff := time.Second
+	for attempt := 0; attempt <= config.fetchRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("retrying in %s (%d/%d): %s", backoff, attempt, config.fetchRetries, err)
+			setFetchState(fmt.Sprintf("retrying in %s (%d/%d): %s", backoff, attempt, config.fetchRetries, err))
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		setFetchState("fetching " + uri)
+		data, err = fetchTorrentOnce(client, uri)
+		if err == nil {
+			break
+		}
+		if _, ok := err.(fetchError); ok {
+			break
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch %s: %s", uri, err)
+	}
+
+	file, err := ioutil.TempFile("", "torrent2http-*.torrent")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func fetchTorrentOnce(client *http.Client, uri string) ([]byte, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, fetchError{err}
+	}
+	req.Header.Set("User-Agent", config.userAgent)
+	for _, header := range config.fetchHeaders {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return nil, fetchError{fmt.Errorf("invalid header %q, expected \"Name: value\"", header)}
+		}
+		req.Header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	log.Printf("fetching: %s", uri)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("server returned %s", resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, fetchError{err}
+		}
+		return nil, err
+	}
+
+	maxSize := int64(config.fetchMaxSize) * 1024 * 1024
+	if resp.ContentLength > maxSize {
+		return nil, fetchError{fmt.Errorf("torrent file is too big (%d bytes)", resp.ContentLength)}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fetchError{fmt.Errorf("torrent file is bigger than %d MB", config.fetchMaxSize)}
+	}
+	// A bencoded torrent is always a dictionary; login pages and
+	// error pages of private trackers are not.
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fetchError{errors.New("response is not a torrent file (content type: " + resp.Header.Get("Content-Type") + ")")}
+	}
+	return data, nil
+}
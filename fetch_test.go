@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCookies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torrent2http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cookies.txt")
+	cookies := "# Netscape HTTP Cookie File\n" +
+		".tracker.example\tTRUE\t/\tFALSE\t0\tshared\t1\n" +
+		"tracker.example\tFALSE\t/\tFALSE\t0\thostonly\t2\n" +
+		"#HttpOnly_tracker.example\tFALSE\t/\tTRUE\t0\tsecure\t3\n"
+	if err := ioutil.WriteFile(path, []byte(cookies), 0644); err != nil {
+		t.Fatal(err)
+	}
+	jar, _ := cookiejar.New(nil)
+	if err := loadCookies(jar, path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url     string
+		cookies []string
+	}{
+		{"http://tracker.example/t.torrent", []string{"shared", "hostonly"}},
+		{"https://tracker.example/t.torrent", []string{"shared", "hostonly", "secure"}},
+		{"http://www.tracker.example/t.torrent", []string{"shared"}},
+		{"http://other.example/t.torrent", nil},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		got := map[string]bool{}
+		for _, cookie := range jar.Cookies(u) {
+			got[cookie.Name] = true
+		}
+		if len(got) != len(test.cookies) {
+			t.Errorf("%s: got %v, want %v", test.url, got, test.cookies)
+			continue
+		}
+		for _, name := range test.cookies {
+			if !got[name] {
+				t.Errorf("%s: got %v, want %v", test.url, got, test.cookies)
+				break
+			}
+		}
+	}
+}
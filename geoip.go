@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPRecord covers the fields used from MaxMind GeoLite2/GeoIP2
+// Country, City and ASN databases, and the combined country+ASN
+// databases that follow the same layout.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+var geoIPReaders []*maxminddb.Reader
+
+// openGeoIP opens the comma-separated -geoip-db files, e.g. a country
+// database and an ASN database.
+func openGeoIP() {
+	for _, path := range strings.Split(config.geoIPDB, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			log.Printf("unable to open GeoIP database %s: %s", path, err)
+			continue
+		}
+		log.Printf("using GeoIP database: %s", path)
+		geoIPReaders = append(geoIPReaders, reader)
+	}
+}
+
+// lookupGeoIP returns the country code, AS number and AS organization of
+// ip, merged across all the opened databases.
+func lookupGeoIP(ip net.IP) (country string, asn uint, asOrg string) {
+	if ip == nil {
+		return
+	}
+	for _, reader := range geoIPReaders {
+		var record geoIPRecord
+		if err := reader.Lookup(ip, &record); err != nil {
+			continue
+		}
+		if country == "" {
+			country = record.Country.ISOCode
+		}
+		if asn == 0 {
+			asn = record.AutonomousSystemNumber
+			asOrg = record.AutonomousSystemOrganization
+		}
+	}
+	return
+}
+
+// peerIP extracts the address from a peer endpoint string such as
+// "1.2.3.4:6881" or "[::1]:6881".
+func peerIP(endpoint string) net.IP {
+	if host, _, err := net.SplitHostPort(endpoint); err == nil {
+		endpoint = host
+	}
+	return net.ParseIP(strings.Trim(endpoint, "[]"))
+}
+
+type PeersGroupInfo struct {
+	Name         string  `json:"name"`
+	Peers        int     `json:"peers"`
+	DownloadRate float32 `json:"download_rate"`
+	UploadRate   float32 `json:"upload_rate"`
+}
+
+type PeersSummaryInfo struct {
+	Countries []PeersGroupInfo `json:"countries"`
+	Clients   []PeersGroupInfo `json:"clients"`
+}
+
+// groupPeers aggregates peers by the name returned by key, busiest
+// groups first.
+func groupPeers(peers []PeerInfo, key func(PeerInfo) string) []PeersGroupInfo {
+	groups := make(map[string]*PeersGroupInfo)
+	for _, peer := range peers {
+		name := key(peer)
+		group, ok := groups[name]
+		if !ok {
+			group = &PeersGroupInfo{Name: name}
+			groups[name] = group
+		}
+		group.Peers++
+		group.DownloadRate += peer.DownSpeed
+		group.UploadRate += peer.UpSpeed
+	}
+	ret := []PeersGroupInfo{}
+	for _, group := range groups {
+		ret = append(ret, *group)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Peers != ret[j].Peers {
+			return ret[i].Peers > ret[j].Peers
+		}
+		return ret[i].DownloadRate > ret[j].DownloadRate
+	})
+	return ret
+}
+
+func peersSummaryHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	peers := collectPeers()
+	ret := PeersSummaryInfo{
+		Countries: groupPeers(peers, func(peer PeerInfo) string {
+			return peer.Country
+		}),
+		Clients: groupPeers(peers, func(peer PeerInfo) string {
+			return peer.Client
+		}),
+	}
+
+	output, _ := json.Marshal(ret)
+	w.Write(output)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// maxPieceLength is the largest piece length accepted, as in libtorrent.
+// verify allocates a buffer of that size.
+const maxPieceLength = 128 * 1024 * 1024
+
+// InspectFile is a file of a torrent, as listed by inspect.
+type InspectFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+	// Pad is set for BEP 47 padding files, which are zeros and not on
+	// disk.
+	Pad bool `json:"pad,omitempty"`
+}
+
+// InspectInfo is the readable form of a .torrent, resume or state file.
+type InspectInfo struct {
+	Path           string        `json:"path"`
+	Type           string        `json:"type"`
+	InfoHash       string        `json:"info_hash,omitempty"`
+	Name           string        `json:"name,omitempty"`
+	SavePath       string        `json:"save_path,omitempty"`
+	PieceLength    int64         `json:"piece_length,omitempty"`
+	NumPieces      int           `json:"num_pieces,omitempty"`
+	PiecesDone     int           `json:"pieces_done"`
+	Pieces         string        `json:"pieces,omitempty"`
+	FilePriorities []int64       `json:"file_priorities,omitempty"`
+	Trackers       []string      `json:"trackers,omitempty"`
+	WebSeeds       []string      `json:"web_seeds,omitempty"`
+	Private        bool          `json:"private,omitempty"`
+	Comment        string        `json:"comment,omitempty"`
+	Files          []InspectFile `json:"files,omitempty"`
+	DhtNodes       int           `json:"dht_nodes,omitempty"`
+	Settings       int           `json:"settings,omitempty"`
+	Keys           []string      `json:"keys"`
+}
+
+// TorrentMeta is what torrent2http needs from a .torrent without
+// libtorrent.
+type TorrentMeta struct {
+	InfoHash    string
+	Name        string
+	PieceLength int64
+	Pieces      []string
+	Files       []InspectFile
+	TotalSize   int64
+	Trackers    []string
+	WebSeeds    []string
+	Private     bool
+	Comment     string
+}
+
+func loadTorrentMeta(filePath string) (*TorrentMeta, error) {
+	dict, infoHash, err := bdecodeFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filePath, err)
+	}
+	meta, err := parseTorrentMeta(dict, infoHash)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filePath, err)
+	}
+	return meta, nil
+}
+
+// parseTorrentMeta reads the info dictionary of a decoded .torrent, or of
+// resume data saved along with the metadata.
+func parseTorrentMeta(dict map[string]interface{}, infoHash string) (*TorrentMeta, error) {
+	info := bencodeDictValue(dict, "info")
+	if info == nil {
+		return nil, fmt.Errorf("no info dictionary")
+	}
+	meta := &TorrentMeta{
+		InfoHash:    infoHash,
+		Name:        bencodeString(info, "name"),
+		PieceLength: bencodeInt(info, "piece length"),
+		Private:     bencodeInt(info, "private") == 1,
+		Comment:     bencodeString(dict, "comment"),
+		Trackers:    torrentTrackers(dict),
+	}
+	if utf8Name := bencodeString(info, "name.utf-8"); utf8Name != "" {
+		meta.Name = utf8Name
+	}
+	if meta.PieceLength <= 0 || meta.PieceLength > maxPieceLength {
+		return nil, fmt.Errorf("invalid piece length")
+	}
+	if !validPathComponent(meta.Name) {
+		return nil, fmt.Errorf("invalid name: %q", meta.Name)
+	}
+	pieces := bencodeString(info, "pieces")
+	if len(pieces)%20 != 0 {
+		return nil, fmt.Errorf("invalid piece hashes")
+	}
+	for i := 0; i < len(pieces); i += 20 {
+		meta.Pieces = append(meta.Pieces, pieces[i:i+20])
+	}
+
+	if files := bencodeList(info, "files"); files != nil {
+		for _, f := range files {
+			file, _ := f.(map[string]interface{})
+			var parts []string
+			for _, p := range bencodeList(file, "path") {
+				s, ok := p.(string)
+				if !ok || !validPathComponent(s) {
+					return nil, fmt.Errorf("invalid file path: %v", bencodeList(file, "path"))
+				}
+				parts = append(parts, s)
+			}
+			if len(parts) == 0 {
+				return nil, fmt.Errorf("invalid file entry")
+			}
+			size := bencodeInt(file, "length")
+			if size < 0 {
+				return nil, fmt.Errorf("invalid file length: %d", size)
+			}
+			meta.Files = append(meta.Files, InspectFile{
+				Path:   path.Join(append([]string{meta.Name}, parts...)...),
+				Size:   size,
+				Offset: meta.TotalSize,
+				Pad:    strings.Contains(bencodeString(file, "attr"), "p"),
+			})
+			meta.TotalSize += size
+		}
+	} else {
+		meta.TotalSize = bencodeInt(info, "length")
+		if meta.TotalSize < 0 {
+			return nil, fmt.Errorf("invalid length: %d", meta.TotalSize)
+		}
+		meta.Files = []InspectFile{{Path: meta.Name, Size: meta.TotalSize}}
+	}
+	if expected := (meta.TotalSize + meta.PieceLength - 1) / meta.PieceLength; int64(len(meta.Pieces)) != expected {
+		return nil, fmt.Errorf("%d piece hashes for %d pieces", len(meta.Pieces), expected)
+	}
+
+	switch seeds := dict["url-list"].(type) {
+	case string:
+		meta.WebSeeds = []string{seeds}
+	case []interface{}:
+		for _, s := range seeds {
+			if seed, ok := s.(string); ok {
+				meta.WebSeeds = append(meta.WebSeeds, seed)
+			}
+		}
+	}
+	return meta, nil
+}
+
+// validPathComponent rejects the file and directory names that would
+// escape the download directory, as libtorrent does when adding the
+// torrent.
+func validPathComponent(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// torrentTrackers lists announce and announce-list, or the trackers of
+// resume data, without duplicates.
+func torrentTrackers(dict map[string]interface{}) []string {
+	var trackers []string
+	seen := map[string]bool{}
+	add := func(tracker string) {
+		if tracker != "" && !seen[tracker] {
+			seen[tracker] = true
+			trackers = append(trackers, tracker)
+		}
+	}
+	add(bencodeString(dict, "announce"))
+	for _, key := range []string{"announce-list", "trackers"} {
+		for _, tier := range bencodeList(dict, key) {
+			list, _ := tier.([]interface{})
+			for _, t := range list {
+				if tracker, ok := t.(string); ok {
+					add(tracker)
+				}
+			}
+		}
+	}
+	return trackers
+}
+
+// inspectData decodes a .torrent, a resume file (-resume-file or
+// -resume-dir) or a session state file (-state-file).
+func inspectData(name string, data []byte) (*InspectInfo, error) {
+	dict, infoHash, err := bdecodeDict(data)
+	if err != nil {
+		return nil, err
+	}
+	ret := &InspectInfo{Path: name, Type: "unknown", InfoHash: infoHash}
+	for key := range dict {
+		ret.Keys = append(ret.Keys, key)
+	}
+	sort.Strings(ret.Keys)
+
+	if meta, err := parseTorrentMeta(dict, infoHash); err == nil {
+		ret.Type = "torrent"
+		ret.Name = meta.Name
+		ret.PieceLength = meta.PieceLength
+		ret.NumPieces = len(meta.Pieces)
+		ret.Trackers = meta.Trackers
+		ret.WebSeeds = meta.WebSeeds
+		ret.Private = meta.Private
+		ret.Comment = meta.Comment
+		ret.Files = meta.Files
+	} else if _, ok := dict["info"]; ok {
+		return nil, fmt.Errorf("invalid info dictionary: %s", err)
+	}
+
+	switch {
+	case bencodeString(dict, "file-format") == "libtorrent resume file":
+		ret.Type = "resume"
+		if hash := bencodeString(dict, "info-hash"); len(hash) == 20 {
+			ret.InfoHash = hex.EncodeToString([]byte(hash))
+		}
+		if ret.Name == "" {
+			ret.Name = bencodeString(dict, "name")
+		}
+		ret.SavePath = bencodeString(dict, "save_path")
+		ret.Trackers = torrentTrackers(dict)
+		pieces := bencodeString(dict, "pieces")
+		ret.NumPieces = len(pieces)
+		bitfield := make(Bitfield, (len(pieces)+7)/8)
+		for i := 0; i < len(pieces); i++ {
+			if pieces[i]&1 != 0 {
+				bitfield.SetBit(i, true)
+				ret.PiecesDone++
+			}
+		}
+		ret.Pieces = bitfield.String()[:len(pieces)]
+		for _, p := range bencodeList(dict, "file_priority") {
+			if priority, ok := p.(int64); ok {
+				ret.FilePriorities = append(ret.FilePriorities, priority)
+			}
+		}
+	case ret.Type == "torrent":
+	case dict["settings"] != nil || dict["dht state"] != nil || dict["dht"] != nil:
+		ret.Type = "state"
+		ret.Settings = len(bencodeDictValue(dict, "settings"))
+		dht := bencodeDictValue(dict, "dht state")
+		if dht == nil {
+			dht = bencodeDictValue(dict, "dht")
+		}
+		ret.DhtNodes = len(bencodeString(dht, "nodes"))/6 + len(bencodeString(dht, "nodes6"))/18
+	}
+	return ret, nil
+}
+
+func inspectFile(filePath string) (*InspectInfo, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := inspectData(filePath, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filePath, err)
+	}
+	return info, nil
+}
+
+// inspectCommand runs "torrent2http inspect <file>...".
+func inspectCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: torrent2http inspect <file.torrent|resume file|state file>...")
+		return 2
+	}
+	ret := 0
+	for _, arg := range args {
+		info, err := inspectFile(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			ret = 1
+			continue
+		}
+		output, _ := json.MarshalIndent(info, "", "  ")
+		fmt.Println(string(output))
+	}
+	return ret
+}
+
+// fileURIPath is the local path of a file:// URI.
+func fileURIPath(fileUri *url.URL) string {
+	uriPath := fileUri.Path
+	if uriPath != "" && runtime.GOOS == "windows" && os.IsPathSeparator(uriPath[0]) {
+		uriPath = uriPath[1:]
+	}
+	return uriPath
+}
+
+// inspectedFile maps the file parameter of /inspect to a path: resume,
+// state or torrent (the local -uri file, or the cached metadata).
+func inspectedFile(name string) string {
+	switch name {
+	case "resume":
+		if resumeFile := getResumeFile(); resumeFile != "" {
+			return resumeFile
+		}
+		return config.resumeFile
+	case "state":
+		return config.stateFile
+	case "torrent":
+		if fileUri, err := url.Parse(config.uri); err == nil && fileUri.Scheme == "file" {
+			return fileURIPath(fileUri)
+		}
+		if torrentHandle != nil && config.metadataCache != "" {
+			return metadataCachePath(currentInfoHash())
+		}
+	}
+	return ""
+}
+
+// inspectHandler decodes the file given by ?file=resume|state|torrent, or
+// the bencoded request body of a POST.
+func inspectHandler(w http.ResponseWriter, r *http.Request) {
+	var info *InspectInfo
+	var err error
+	if r.Method == "POST" {
+		data, readErr := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 16*1024*1024))
+		if readErr != nil {
+			http.Error(w, readErr.Error(), http.StatusBadRequest)
+			return
+		}
+		info, err = inspectData("", data)
+	} else {
+		filePath := inspectedFile(r.URL.Query().Get("file"))
+		if filePath == "" {
+			http.Error(w, "file must be one of: resume, state, torrent", http.StatusNotFound)
+			return
+		}
+		if _, statErr := os.Stat(filePath); statErr != nil {
+			http.Error(w, statErr.Error(), http.StatusNotFound)
+			return
+		}
+		info, err = inspectFile(filePath)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	output, _ := json.Marshal(info)
+	w.Write(output)
+}
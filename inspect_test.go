@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testTorrentInfo returns a multi-file .torrent with files, each
+// "<path>:<length>[:<attr>]".
+func testTorrentInfo(name string, pieceLength int64, files ...string) map[string]interface{} {
+	var list []interface{}
+	var total int64
+	for _, f := range files {
+		fields := strings.Split(f, ":")
+		length, _ := strconv.ParseInt(fields[1], 10, 64)
+		var parts []interface{}
+		for _, part := range strings.Split(fields[0], "/") {
+			parts = append(parts, part)
+		}
+		file := map[string]interface{}{"length": length, "path": parts}
+		if len(fields) > 2 {
+			file["attr"] = fields[2]
+		}
+		list = append(list, file)
+		total += length
+	}
+	numPieces := int64(1)
+	if pieceLength > 0 {
+		numPieces = (total + pieceLength - 1) / pieceLength
+	}
+	return map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         name,
+			"piece length": pieceLength,
+			"pieces":       strings.Repeat("x", int(numPieces)*20),
+			"files":        list,
+		},
+	}
+}
+
+func TestParseTorrentMeta(t *testing.T) {
+	tests := []struct {
+		desc string
+		dict map[string]interface{}
+		ok   bool
+	}{
+		{"valid", testTorrentInfo("t", 16384, "a/b.mkv:20000", "c.srt:100"), true},
+		{"pad file", testTorrentInfo("t", 16384, "a.mkv:20000", ".pad/12768:12768:p", "b.mkv:100"), true},
+		{"dot dot in path", testTorrentInfo("t", 16384, "../evil:100"), false},
+		{"dot dot in name", testTorrentInfo("..", 16384, "evil:100"), false},
+		{"slash in a component", testTorrentInfo("t", 16384, "a\\..\\..\\evil:100"), false},
+		{"empty component", testTorrentInfo("t", 16384, "a//b:100"), false},
+		{"negative length", testTorrentInfo("t", 16384, "a:-1", "b:100"), false},
+		{"huge pieces", testTorrentInfo("t", 1<<40, "a:100"), false},
+		{"zero piece length", testTorrentInfo("t", 0, "a:100"), false},
+	}
+	for _, test := range tests {
+		meta, err := parseTorrentMeta(test.dict, "")
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.desc, err)
+			continue
+		}
+		if test.desc == "pad file" && (!meta.Files[1].Pad || meta.Files[0].Pad || meta.Files[2].Offset != 32768) {
+			t.Errorf("%s: got files %+v", test.desc, meta.Files)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+const ipFilterBlocked = 1
+
+// IPRange is an inclusive range of addresses of the same family.
+type IPRange struct {
+	First net.IP
+	Last  net.IP
+}
+
+func (r IPRange) String() string {
+	if r.First.Equal(r.Last) {
+		return r.First.String()
+	}
+	return r.First.String() + "-" + r.Last.String()
+}
+
+func (r IPRange) Contains(ip net.IP) bool {
+	ip = normalizeIP(ip)
+	if ip == nil || len(ip) != len(r.First) {
+		return false
+	}
+	return bytes.Compare(ip, r.First) >= 0 && bytes.Compare(ip, r.Last) <= 0
+}
+
+var (
+	ipFilterLock sync.Mutex
+	// ipFilter is the filter installed in the session. It's rebuilt when
+	// the blocklist changes, and updated in place by bans and
+	// disconnections.
+	ipFilter lt.IpFilter
+	// bannedRanges are the ranges banned through /peers/ban for the
+	// rest of the session.
+	bannedRanges []IPRange
+	// blocklistRanges are the ranges loaded from -blocklist.
+	blocklistRanges []IPRange
+	// disconnectRanges are the peers being disconnected by
+	// disconnectIPRange.
+	disconnectRanges []IPRange
+)
+
+// normalizeIP returns the 4-byte form of IPv4 addresses, so ranges of
+// different families never compare equal.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// parseIPRange accepts a single address, a CIDR block or a
+// "first-last" range.
+func parseIPRange(s string) (IPRange, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return IPRange{}, err
+		}
+		first := normalizeIP(network.IP)
+		last := make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^network.Mask[len(network.Mask)-len(first)+i]
+		}
+		return IPRange{First: first, Last: last}, nil
+	}
+	if parts := strings.SplitN(s, "-", 2); len(parts) == 2 {
+		first := normalizeIP(net.ParseIP(strings.TrimSpace(parts[0])))
+		last := normalizeIP(net.ParseIP(strings.TrimSpace(parts[1])))
+		if first == nil || last == nil || len(first) != len(last) || bytes.Compare(first, last) > 0 {
+			return IPRange{}, fmt.Errorf("invalid IP range: %s", s)
+		}
+		return IPRange{First: first, Last: last}, nil
+	}
+	ip := normalizeIP(net.ParseIP(s))
+	if ip == nil {
+		return IPRange{}, fmt.Errorf("invalid IP address: %s", s)
+	}
+	return IPRange{First: ip, Last: ip}, nil
+}
+
+func (r IPRange) Overlaps(other IPRange) bool {
+	return len(r.First) == len(other.First) &&
+		bytes.Compare(r.First, other.Last) <= 0 && bytes.Compare(other.First, r.Last) <= 0
+}
+
+func removeIPRange(ranges []IPRange, r IPRange) ([]IPRange, bool) {
+	for i, other := range ranges {
+		if other.First.Equal(r.First) && other.Last.Equal(r.Last) {
+			return append(ranges[:i], ranges[i+1:]...), true
+		}
+	}
+	return ranges, false
+}
+
+// filterRanges returns the blocklist, banned and disconnected ranges.
+// ipFilterLock must be held.
+func filterRanges() []IPRange {
+	return append(append(append([]IPRange{}, blocklistRanges...), bannedRanges...), disconnectRanges...)
+}
+
+// setIPFilterRule sets the access of a range in ipFilter. ipFilterLock
+// must be held.
+func setIPFilterRule(r IPRange, access int) {
+	first := lt.AddressFromString(r.First.String())
+	defer lt.DeleteAddress(first)
+	last := lt.AddressFromString(r.Last.String())
+	defer lt.DeleteAddress(last)
+	ipFilter.AddRule(first, last, access)
+}
+
+// installIPFilter hands ipFilter to the session. libtorrent disconnects
+// connected peers that it blocks. ipFilterLock must be held.
+func installIPFilter() {
+	session.SetIpFilter(ipFilter)
+	log.Printf("ip filter updated: %d rule(s)", len(blocklistRanges)+len(bannedRanges)+len(disconnectRanges))
+}
+
+// applyIPFilter rebuilds the session IP filter from all the ranges, e.g.
+// once the blocklist is (re)loaded.
+func applyIPFilter() {
+	ipFilterLock.Lock()
+	defer ipFilterLock.Unlock()
+
+	if ipFilter != nil {
+		lt.DeleteIpFilter(ipFilter)
+	}
+	ipFilter = lt.NewIpFilter()
+	for _, r := range filterRanges() {
+		setIPFilterRule(r, ipFilterBlocked)
+	}
+	installIPFilter()
+}
+
+// blockIPRange adds r to *ranges and blocks it, without rebuilding the
+// filter.
+func blockIPRange(ranges *[]IPRange, r IPRange) {
+	ipFilterLock.Lock()
+	defer ipFilterLock.Unlock()
+
+	*ranges = append(*ranges, r)
+	if ipFilter == nil {
+		ipFilter = lt.NewIpFilter()
+	}
+	setIPFilterRule(r, ipFilterBlocked)
+	installIPFilter()
+}
+
+// unblockIPRange removes r from *ranges and allows it again, except for
+// the parts still blocked by other ranges. It returns false if r wasn't
+// in *ranges.
+func unblockIPRange(ranges *[]IPRange, r IPRange) bool {
+	ipFilterLock.Lock()
+	defer ipFilterLock.Unlock()
+
+	var found bool
+	if *ranges, found = removeIPRange(*ranges, r); !found || ipFilter == nil {
+		return found
+	}
+	setIPFilterRule(r, 0)
+	for _, other := range filterRanges() {
+		if other.Overlaps(r) {
+			setIPFilterRule(other, ipFilterBlocked)
+		}
+	}
+	installIPFilter()
+	return true
+}
+
+// banIPRange blocks a range for the rest of the session.
+func banIPRange(r IPRange) {
+	log.Printf("banning %s", r)
+	blockIPRange(&bannedRanges, r)
+}
+
+// unbanIPRange lifts a ban set with banIPRange, returning false if there
+// was no such ban.
+func unbanIPRange(r IPRange) bool {
+	if !unblockIPRange(&bannedRanges, r) {
+		return false
+	}
+	log.Printf("unbanned %s", r)
+	return true
+}
+
+// disconnectIPRange blocks a range for the given time, which makes
+// libtorrent drop the connections to it.
+func disconnectIPRange(r IPRange, duration time.Duration) {
+	blockIPRange(&disconnectRanges, r)
+	time.AfterFunc(duration, func() {
+		unblockIPRange(&disconnectRanges, r)
+	})
+}
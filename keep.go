@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	fileKeepLock sync.Mutex
+	// fileKeep overrides the -keep-* policy for single files.
+	fileKeep = map[int]bool{}
+)
+
+// keepFile tells whether file index is left on disk on exit, according
+// to its override or to -keep-files, -keep-complete and -keep-incomplete.
+func keepFile(index int, completed bool) bool {
+	fileKeepLock.Lock()
+	keep, ok := fileKeep[index]
+	fileKeepLock.Unlock()
+	if ok {
+		return keep
+	}
+	return config.keepFiles || (config.keepComplete && completed) || (config.keepIncomplete && !completed)
+}
+
+func hasKeepOverrides() bool {
+	fileKeepLock.Lock()
+	defer fileKeepLock.Unlock()
+	return len(fileKeep) > 0
+}
+
+func setFileKeep(index int, keep bool) {
+	fileKeepLock.Lock()
+	defer fileKeepLock.Unlock()
+	fileKeep[index] = keep
+}
+
+func clearFileKeep(index int) {
+	fileKeepLock.Lock()
+	defer fileKeepLock.Unlock()
+	delete(fileKeep, index)
+}
+
+// deleteFileData stops downloading file index and removes it from disk.
+func deleteFileData(index int) error {
+	files := torrentInfo.Files()
+	torrentHandle.FilePriority(index, 0)
+	torrentHandle.FlushCache()
+	setFileKeep(index, false)
+	requestResumeSave("file deleted")
+
+	savePath := fileDiskPath(files, index)
+	if _, err := os.Stat(savePath); os.IsNotExist(err) {
+		return nil
+	}
+	log.Printf("deleting file data: %s", savePath)
+	if err := os.Remove(savePath); err != nil {
+		// still open on some systems, it'll be removed on exit
+		return err
+	}
+	removeEmptyParents(savePath)
+	publishEvent("file_deleted", "%s", originalFilePath(files, index))
+	return nil
+}
+
+// removeEmptyParents removes the directories between file and -dl-path
+// that are left empty.
+func removeEmptyParents(file string) {
+	dir := filepath.Dir(file)
+	savePath, _ := filepath.Abs(getSavePath())
+	savePath = trimPathSeparator(savePath)
+	for dir != savePath && strings.HasPrefix(dir, savePath) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = trimPathSeparator(filepath.Dir(dir))
+	}
+}
+
+// fileActionHandler handles the non-GET requests under /files/:
+//   POST /files/<index>/keep?keep=true|false marks a file to keep or discard
+//   DELETE /files/<index>/keep restores the -keep-* policy for it
+//   DELETE /files/<index> deletes the file data now and stops downloading it
+//   POST /files/<index>/rename?name=<path> renames the file in the torrent
+func fileActionHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/files/"), "/"), "/")
+	index, err := strconv.Atoi(parts[0])
+	if err != nil || torrentInfo == nil || index < 0 || index >= torrentInfo.NumFiles() {
+		http.Error(w, "invalid file index: "+parts[0], http.StatusNotFound)
+		return
+	}
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	switch {
+	case action == "keep" && r.Method == "POST":
+		keep, err := strconv.ParseBool(r.URL.Query().Get("keep"))
+		if err != nil {
+			http.Error(w, "keep must be true or false", http.StatusBadRequest)
+			return
+		}
+		setFileKeep(index, keep)
+		fmt.Fprintf(w, "file %d: keep=%t", index, keep)
+	case action == "keep" && r.Method == "DELETE":
+		clearFileKeep(index)
+		fmt.Fprintf(w, "file %d: default keep policy", index)
+	case action == "rename" && r.Method == "POST":
+		renameHandler(w, r, index)
+	case action == "" && r.Method == "DELETE":
+		if (index == fileEntryIdx && atomic.LoadInt32(&activeReaders) > 0) || (torrentFS != nil && torrentFS.IsOpen(index)) {
+			http.Error(w, "file is being streamed", http.StatusConflict)
+			return
+		}
+		if err := deleteFileData(index); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "file %d will be deleted on exit: %s", index, err)
+			return
+		}
+		fmt.Fprintf(w, "file %d deleted", index)
+	default:
+		http.Error(w, "unsupported request", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// MagnetOptions holds the magnet link parameters torrent2http applies
+// itself, on top of what libtorrent parses from the link.
+type MagnetOptions struct {
+	InfoHash   string
+	Trackers   []string    // tr=
+	WebSeeds   []string    // ws=
+	Peers      []string    // x.pe=
+	SelectOnly []FileRange // so= (BEP 53)
+}
+
+// FileRange is an inclusive range of file indices.
+type FileRange struct {
+	First int
+	Last  int
+}
+
+// normalizeInfoHash converts a 40-char hex or 32-char base32 info-hash
+// to lowercase hex. Returns "" if the string is neither.
+func normalizeInfoHash(hash string) string {
+	switch len(hash) {
+	case 40:
+		if _, err := hex.DecodeString(hash); err == nil {
+			return strings.ToLower(hash)
+		}
+	case 32:
+		if data, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash)); err == nil {
+			return hex.EncodeToString(data)
+		}
+	}
+	return ""
+}
+
+// infoHashFromMagnet returns the lowercase hex info-hash from the xt
+// parameter of a magnet link, or "" if there is none.
+func infoHashFromMagnet(uri string) string {
+	if magnet := parseMagnet(uri); magnet != nil {
+		return magnet.InfoHash
+	}
+	return ""
+}
+
+// magnetFromInfoHash turns a bare info-hash into a magnet link.
+// Any other string is returned unchanged.
+func magnetFromInfoHash(uri string) string {
+	if hash := normalizeInfoHash(strings.TrimSpace(uri)); hash != "" {
+		return "magnet:?xt=urn:btih:" + hash
+	}
+	return uri
+}
+
+// parseMagnet parses a magnet link, returning nil if uri isn't one.
+func parseMagnet(uri string) *MagnetOptions {
+	magnetURI, err := url.Parse(uri)
+	if err != nil || magnetURI.Scheme != "magnet" {
+		return nil
+	}
+	query := magnetURI.Query()
+	magnet := &MagnetOptions{
+		Trackers: query["tr"],
+		WebSeeds: query["ws"],
+		Peers:    query["x.pe"],
+	}
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(strings.ToLower(xt), "urn:btih:") {
+			continue
+		}
+		if hash := normalizeInfoHash(xt[len("urn:btih:"):]); hash != "" {
+			magnet.InfoHash = hash
+			break
+		}
+	}
+	for _, so := range query["so"] {
+		magnet.SelectOnly = append(magnet.SelectOnly, parseSelectOnly(so)...)
+	}
+	return magnet
+}
+
+// parseSelectOnly parses a BEP 53 file list, e.g. "0,2,4-6". Malformed
+// items are skipped. Ranges are kept as such, the number of files isn't
+// known before the metadata.
+func parseSelectOnly(so string) []FileRange {
+	var ranges []FileRange
+	for _, item := range strings.Split(so, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(item), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			continue
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				continue
+			}
+		}
+		ranges = append(ranges, FileRange{First: first, Last: last})
+	}
+	return ranges
+}
+
+// mergeTrackers concatenates tracker lists, dropping blanks and duplicates.
+func mergeTrackers(lists ...[]string) []string {
+	seen := make(map[string]bool)
+	var trackers []string
+	for _, list := range lists {
+		for _, tracker := range list {
+			tracker = strings.TrimSpace(tracker)
+			if tracker == "" || seen[tracker] {
+				continue
+			}
+			seen[tracker] = true
+			trackers = append(trackers, tracker)
+		}
+	}
+	return trackers
+}
+
+// selectedFiles returns the valid file indices requested with so= in the
+// magnet link, or nil if there was no selection.
+func (magnet *MagnetOptions) selectedFiles(numFiles int) map[int]bool {
+	if magnet == nil || len(magnet.SelectOnly) == 0 {
+		return nil
+	}
+	selected := make(map[int]bool)
+	for _, r := range magnet.SelectOnly {
+		last := r.Last
+		if last > numFiles-1 {
+			last = numFiles - 1
+		}
+		for index := r.First; index <= last; index++ {
+			selected[index] = true
+		}
+	}
+	return selected
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelectOnly(t *testing.T) {
+	tests := []struct {
+		so     string
+		ranges []FileRange
+	}{
+		{"", nil},
+		{"0", []FileRange{{0, 0}}},
+		{"0,2,4-6", []FileRange{{0, 0}, {2, 2}, {4, 6}}},
+		{" 1 , 3-3 ", []FileRange{{1, 1}, {3, 3}}},
+		{"x,-1,5-2,7-y,8", []FileRange{{8, 8}}},
+		{"0-2147483647", []FileRange{{0, 2147483647}}},
+	}
+	for _, test := range tests {
+		if ranges := parseSelectOnly(test.so); !reflect.DeepEqual(ranges, test.ranges) {
+			t.Errorf("parseSelectOnly(%q) = %v, want %v", test.so, ranges, test.ranges)
+		}
+	}
+}
+
+func TestSelectedFiles(t *testing.T) {
+	tests := []struct {
+		so       string
+		numFiles int
+		selected map[int]bool
+	}{
+		{"", 3, nil},
+		{"0,2", 3, map[int]bool{0: true, 2: true}},
+		{"1-5", 3, map[int]bool{1: true, 2: true}},
+		// a huge range is clamped to the files of the torrent
+		{"0-2147483647", 2, map[int]bool{0: true, 1: true}},
+		{"7", 3, map[int]bool{}},
+	}
+	for _, test := range tests {
+		magnet := &MagnetOptions{SelectOnly: parseSelectOnly(test.so)}
+		if selected := magnet.selectedFiles(test.numFiles); !reflect.DeepEqual(selected, test.selected) {
+			t.Errorf("so=%s with %d files: selected %v, want %v", test.so, test.numFiles, selected, test.selected)
+		}
+	}
+}
+
+func TestNormalizeInfoHash(t *testing.T) {
+	tests := []struct {
+		hash string
+		want string
+	}{
+		{"EAB8FB63830D5E5408549F90D750D5D82CD1689E", "eab8fb63830d5e5408549f90d750d5d82cd1689e"},
+		{"5K4PWY4DBVPFICCUT6INOUGV3AWNC2E6", "eab8fb63830d5e5408549f90d750d5d82cd1689e"},
+		{"not a hash", ""},
+	}
+	for _, test := range tests {
+		if got := normalizeInfoHash(test.hash); got != test.want {
+			t.Errorf("normalizeInfoHash(%q) = %q, want %q", test.hash, got, test.want)
+		}
+	}
+}
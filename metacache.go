@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+const metadataCacheExt = ".torrent"
+
+func metadataCachePath(infoHash string) string {
+	return filepath.Join(config.metadataCache, infoHash+metadataCacheExt)
+}
+
+// loadCachedMetadata returns the torrent info stored in the metadata cache
+// for the given info-hash, or nil on a cache miss.
+func loadCachedMetadata(infoHash string) lt.TorrentInfo {
+	if config.metadataCache == "" || infoHash == "" {
+		return nil
+	}
+	cachePath := metadataCachePath(infoHash)
+	if _, err := os.Stat(cachePath); err != nil {
+		return nil
+	}
+	errorCode := lt.NewErrorCode()
+	defer lt.DeleteErrorCode(errorCode)
+	info := lt.NewTorrentInfo(cachePath, errorCode)
+	if errorCode.Value() != 0 {
+		log.Printf("discarding corrupt cached metadata %s: %s", cachePath, errorCode.Message())
+		os.Remove(cachePath)
+		return nil
+	}
+	if config.metadataCachePolicy == "lru" {
+		now := time.Now()
+		os.Chtimes(cachePath, now, now)
+	}
+	log.Printf("using cached metadata: %s", cachePath)
+	return info
+}
+
+// saveMetadataToCache stores the metadata of the current torrent, along
+// with its trackers, so that reopening the same magnet skips the
+// metadata phase.
+func saveMetadataToCache() {
+	if config.metadataCache == "" || torrentInfo == nil {
+		return
+	}
+	status := torrentHandle.Status()
+	infoHash := hex.EncodeToString([]byte(status.GetInfoHash().ToString()))
+	lt.DeleteTorrentStatus(status)
+
+	cachePath := metadataCachePath(infoHash)
+	if _, err := os.Stat(cachePath); err == nil {
+		return
+	}
+	if err := os.MkdirAll(config.metadataCache, 0755); err != nil {
+		log.Println(err)
+		return
+	}
+
+	torrentFile := lt.NewCreateTorrent(torrentInfo)
+	defer lt.DeleteCreateTorrent(torrentFile)
+	trackers := torrentHandle.Trackers()
+	for i := 0; i < int(trackers.Size()); i++ {
+		entry := trackers.Get(i)
+		torrentFile.AddTracker(entry.GetUrl(), int(entry.GetTier()))
+	}
+	entry := torrentFile.Generate()
+	data := lt.Bencode(entry)
+
+	log.Printf("saving metadata to cache: %s", cachePath)
+	if err := ioutil.WriteFile(cachePath, []byte(data), 0644); err != nil {
+		log.Println(err)
+		return
+	}
+	evictMetadataCache()
+}
+
+// evictMetadataCache removes cached files until the cache fits into
+// -metadata-cache-size. With the lru policy file times are refreshed on
+// every hit, with fifo they are not, so the oldest file goes first either way.
+func evictMetadataCache() {
+	if config.metadataCacheSize <= 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(config.metadataCache)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var cached []os.FileInfo
+	totalSize := int64(0)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != metadataCacheExt {
+			continue
+		}
+		cached = append(cached, entry)
+		totalSize += entry.Size()
+	}
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].ModTime().Before(cached[j].ModTime())
+	})
+	limit := int64(config.metadataCacheSize) * 1024 * 1024
+	for _, entry := range cached {
+		if totalSize <= limit {
+			break
+		}
+		log.Printf("evicting cached metadata: %s", entry.Name())
+		if err := os.Remove(filepath.Join(config.metadataCache, entry.Name())); err != nil {
+			log.Println(err)
+			continue
+		}
+		totalSize -= entry.Size()
+	}
+}
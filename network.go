@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	interfaceCheckInterval = 5 * time.Second
+	// maxPortMappingEvents is how many portmap alerts /network keeps.
+	maxPortMappingEvents = 20
+)
+
+var (
+	// chosenPort is the port picked by chooseListenPort.
+	chosenPort        int
+	portMappingLock   sync.Mutex
+	portMappingEvents []string
+)
+
+type NetworkInfo struct {
+	ListenInterfaces  []string       `json:"listen_interfaces"`
+	OutgoingInterface string         `json:"outgoing_interface"`
+	PortRange         string         `json:"port_range"`
+	PortMode          string         `json:"port_mode"`
+	ChosenPort        int            `json:"chosen_port"`
+	ListenPort        int            `json:"listen_port"`
+	SslListenPort     int            `json:"ssl_listen_port"`
+	IsListening       bool           `json:"is_listening"`
+	MappedPorts       map[string]int `json:"mapped_ports"`
+	PortMappings      []string       `json:"port_mappings"`
+	KillSwitch        bool           `json:"kill_switch"`
+	KillSwitchPaused  bool           `json:"kill_switch_paused"`
+}
+
+var (
+	killSwitchLock sync.Mutex
+	// killSwitchPaused is set while the session is paused because a bound
+	// interface is missing, from startup until the first check passes, so
+	// that a pause requested by the user is not undone when it comes back.
+	killSwitchPaused bool
+)
+
+func setKillSwitchPaused(paused bool) {
+	killSwitchLock.Lock()
+	killSwitchPaused = paused
+	killSwitchLock.Unlock()
+}
+
+func isKillSwitchPaused() bool {
+	killSwitchLock.Lock()
+	defer killSwitchLock.Unlock()
+	return killSwitchPaused
+}
+
+// splitList splits a comma-separated option, dropping blanks.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// listenHosts returns the -listen-interfaces entries in the form libtorrent
+// expects in listen_interfaces, i.e. with IPv6 addresses in brackets.
+// Interface names are passed through, libtorrent resolves them itself.
+func listenHosts() []string {
+	var hosts []string
+	for _, item := range splitList(config.listenInterfaces) {
+		item = strings.Trim(item, "[]")
+		if ip := net.ParseIP(item); ip != nil && ip.To4() == nil {
+			item = "[" + item + "]"
+		}
+		hosts = append(hosts, item)
+	}
+	return hosts
+}
+
+// boundInterfaces returns the interface names and addresses the session
+// is pinned to, leaving out the wildcard addresses.
+func boundInterfaces() []string {
+	var bound []string
+	for _, item := range append(splitList(config.listenInterfaces), splitList(config.outgoingInterface)...) {
+		item = strings.Trim(item, "[]")
+		if ip := net.ParseIP(item); ip != nil && ip.IsUnspecified() {
+			continue
+		}
+		bound = append(bound, item)
+	}
+	return bound
+}
+
+// interfaceAvailable tells whether the named interface, or the interface
+// holding the given address, exists and is up.
+func interfaceAvailable(name string) bool {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(name)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if ip == nil {
+			if iface.Name == name {
+				return true
+			}
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// interfaceKillSwitch pauses the session while any bound interface is
+// missing or down, e.g. when a VPN drops, and resumes it afterwards. The
+// session starts paused and is resumed once all of them are up.
+func interfaceKillSwitch() {
+	bound := boundInterfaces()
+	if len(bound) == 0 {
+		log.Println("kill switch enabled, but no interface or address is bound")
+		setKillSwitchPaused(false)
+		session.Resume()
+		return
+	}
+	log.Printf("kill switch watching: %s", strings.Join(bound, ", "))
+	for {
+		missing := ""
+		for _, name := range bound {
+			if !interfaceAvailable(name) {
+				missing = name
+				break
+			}
+		}
+		paused := isKillSwitchPaused()
+		if missing != "" && !paused {
+			log.Printf("interface %s is gone, pausing session", missing)
+			publishEvent("interface_down", "%s is gone, session paused", missing)
+			setKillSwitchPaused(true)
+			session.Pause()
+		} else if missing == "" && paused {
+			log.Println("bound interfaces are up, resuming session")
+			publishEvent("interface_up", "bound interfaces are up, session resumed")
+			setKillSwitchPaused(false)
+			session.Resume()
+		}
+		time.Sleep(interfaceCheckInterval)
+	}
+}
+
+// parsePortRange parses "6881" or "6881-6889".
+func parsePortRange(ports string) (int, int, error) {
+	parts := strings.SplitN(ports, "-", 2)
+	lower, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port: %s", parts[0])
+	}
+	upper := lower
+	if len(parts) == 2 {
+		if upper, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return 0, 0, fmt.Errorf("invalid port: %s", parts[1])
+		}
+	}
+	if lower < 1 || upper > 65535 || lower > upper {
+		return 0, 0, fmt.Errorf("invalid port range: %s", ports)
+	}
+	return lower, upper, nil
+}
+
+// listenPortRange returns the ports to choose from: -listen-ports if set,
+// the dynamic range with -random-port, or -listen-port and the next five.
+func listenPortRange() (int, int) {
+	if config.listenPorts != "" {
+		lower, upper, _ := parsePortRange(config.listenPorts)
+		return lower, upper
+	}
+	if config.randomPort {
+		return 49152, 65535
+	}
+	return config.listenPort, config.listenPort + 5
+}
+
+// portAvailable tells whether port can be bound for both TCP and UDP.
+func portAvailable(port int) bool {
+	address := ":" + strconv.Itoa(port)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func readPortFile() int {
+	data, err := ioutil.ReadFile(config.portFile)
+	if err != nil {
+		return 0
+	}
+	port, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return port
+}
+
+// chooseListenPort picks the listen port according to -port-mode,
+// preferring the one saved in -port-file, and skipping ports that are
+// already in use.
+func chooseListenPort() int {
+	lower, upper := listenPortRange()
+	candidates := make([]int, 0, upper-lower+1)
+	for port := lower; port <= upper; port++ {
+		candidates = append(candidates, port)
+	}
+	if config.portMode == "random" {
+		rand.Seed(time.Now().UTC().UnixNano())
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+	if config.portFile != "" {
+		if saved := readPortFile(); saved >= lower && saved <= upper {
+			candidates = append([]int{saved}, candidates...)
+		}
+	}
+
+	port := 0
+	for _, candidate := range candidates {
+		if portAvailable(candidate) {
+			port = candidate
+			break
+		}
+		log.Printf("port %d is in use", candidate)
+	}
+	if port == 0 {
+		port = candidates[0]
+		log.Printf("no free port in %d-%d, trying %d anyway", lower, upper, port)
+	}
+	if config.portFile != "" {
+		if err := ioutil.WriteFile(config.portFile, []byte(strconv.Itoa(port)+"\n"), 0644); err != nil {
+			log.Printf("unable to save listen port to %s: %s", config.portFile, err)
+		}
+	}
+	return port
+}
+
+// addPortMappingEvent records the outcome of a UPnP/NAT-PMP mapping, as
+// reported by portmap_alert and portmap_error_alert.
+func addPortMappingEvent(message string) {
+	portMappingLock.Lock()
+	defer portMappingLock.Unlock()
+	portMappingEvents = append(portMappingEvents, message)
+	if len(portMappingEvents) > maxPortMappingEvents {
+		portMappingEvents = portMappingEvents[len(portMappingEvents)-maxPortMappingEvents:]
+	}
+}
+
+func networkHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	lower, upper := listenPortRange()
+	portMappingLock.Lock()
+	portMappings := append([]string{}, portMappingEvents...)
+	portMappingLock.Unlock()
+
+	info := NetworkInfo{
+		ListenInterfaces:  listenHosts(),
+		OutgoingInterface: config.outgoingInterface,
+		PortRange:         fmt.Sprintf("%d-%d", lower, upper),
+		PortMode:          config.portMode,
+		ChosenPort:        chosenPort,
+		ListenPort:        session.ListenPort(),
+		SslListenPort:     session.SslListenPort(),
+		IsListening:       session.IsListening(),
+		MappedPorts:       mappedPorts,
+		PortMappings:      portMappings,
+		KillSwitch:        config.killSwitch,
+		KillSwitchPaused:  isKillSwitchPaused(),
+	}
+	output, _ := json.Marshal(info)
+	w.Write(output)
+}
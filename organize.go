@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+// libraryFile is the name of the organizer mapping, in -organize-dir.
+const libraryFile = ".torrent2http-library.json"
+
+var (
+	videoExtensions    = []string{".mkv", ".mp4", ".avi", ".m4v", ".mov", ".wmv", ".ts", ".webm", ".mpg", ".mpeg"}
+	subtitleExtensions = []string{".srt", ".sub", ".idx", ".ass", ".ssa", ".vtt"}
+
+	episodeRe    = regexp.MustCompile(`(?i)^(.*?)[ ._\-\[(]*s(\d{1,2})[ ._\-]?e(\d{1,3})`)
+	episodeAltRe = regexp.MustCompile(`(?i)^(.*?)[ ._\-\[(]+(\d{1,2})x(\d{2,3})(?:[^\d]|$)`)
+	seasonRe     = regexp.MustCompile(`(?i)^(.*?)[ ._\-\[(]+s(?:eason[ ._]?)?(\d{1,2})(?:[^\de]|$)`)
+	yearRe       = regexp.MustCompile(`^(.*?)[ ._\-\[(]+((?:19|20)\d{2})(?:[^\d]|$)`)
+	// bareEpisodeRe matches the file names of season packs, e.g. "02" or
+	// "E02 - Title".
+	bareEpisodeRe = regexp.MustCompile(`(?i)^(?:e|ep|episode)?[ ._\-]?(\d{1,3})(?:[ ._\-]|$)`)
+	spacesRe      = regexp.MustCompile(`\s+`)
+)
+
+// LibraryEntry records where the organizer put a torrent file.
+type LibraryEntry struct {
+	Original string `json:"original"`
+	Path     string `json:"path"`
+	Moved    bool   `json:"moved"`
+}
+
+// MediaInfo is what could be parsed from a torrent or file name.
+type MediaInfo struct {
+	Title   string
+	Year    int
+	Season  int
+	Episode int
+}
+
+var (
+	libraryLock sync.RWMutex
+	// libraryEntries maps file indexes of the main torrent to their
+	// place in -organize-dir.
+	libraryEntries = map[int]LibraryEntry{}
+)
+
+func hasExtension(name string, extensions []string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanTitle(title string) string {
+	title = strings.NewReplacer(".", " ", "_", " ").Replace(title)
+	title = strings.Trim(spacesRe.ReplaceAllString(title, " "), " -[(")
+	return title
+}
+
+// parseMediaName extracts the title and either the season and episode
+// (SxxEyy or 1x02), the season of a season pack, or the year from a
+// release name.
+func parseMediaName(name string) (MediaInfo, bool) {
+	for _, re := range []*regexp.Regexp{episodeRe, episodeAltRe} {
+		if m := re.FindStringSubmatch(name); m != nil {
+			season, _ := strconv.Atoi(m[2])
+			episode, _ := strconv.Atoi(m[3])
+			info := MediaInfo{Title: cleanTitle(m[1]), Season: season, Episode: episode}
+			if ym := yearRe.FindStringSubmatch(m[1]); ym != nil {
+				info.Title = cleanTitle(ym[1])
+				info.Year, _ = strconv.Atoi(ym[2])
+			}
+			return info, true
+		}
+	}
+	if m := seasonRe.FindStringSubmatch(name); m != nil && m[1] != "" {
+		season, _ := strconv.Atoi(m[2])
+		return MediaInfo{Title: cleanTitle(m[1]), Season: season}, true
+	}
+	if m := yearRe.FindStringSubmatch(name); m != nil && m[1] != "" {
+		year, _ := strconv.Atoi(m[2])
+		return MediaInfo{Title: cleanTitle(m[1]), Year: year}, true
+	}
+	return MediaInfo{}, false
+}
+
+// mediaInfoForFile parses the file name, falling back to the torrent name,
+// and to the directories in between, e.g. for "Show.S01/01.mkv".
+func mediaInfoForFile(torrentName string, filePath string) (MediaInfo, bool) {
+	base := path.Base(filePath)
+	base = strings.TrimSuffix(base, path.Ext(base))
+	info, ok := parseMediaName(base)
+	if ok && info.Title != "" {
+		return info, true
+	}
+	for dir := path.Dir(filePath); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if dirInfo, dirOk := parseMediaName(path.Base(dir)); dirOk {
+			info = mergeMediaInfo(dirInfo, info, ok, base)
+			return info, info.Title != ""
+		}
+	}
+	if torrentInfo, torrentOk := parseMediaName(torrentName); torrentOk {
+		info = mergeMediaInfo(torrentInfo, info, ok, base)
+		return info, info.Title != ""
+	}
+	return info, ok && info.Title != ""
+}
+
+// mergeMediaInfo takes the title from parent and what the file name
+// tells about the episode.
+func mergeMediaInfo(parent MediaInfo, file MediaInfo, fileOk bool, base string) MediaInfo {
+	if fileOk && file.Episode > 0 {
+		parent.Season = file.Season
+		parent.Episode = file.Episode
+	} else if parent.Season > 0 && parent.Episode == 0 {
+		// a season pack, the file name may be just the episode number
+		if m := bareEpisodeRe.FindStringSubmatch(base); m != nil {
+			parent.Episode, _ = strconv.Atoi(m[1])
+		} else {
+			parent.Title = ""
+		}
+	}
+	return parent
+}
+
+// libraryPath expands -organize-movie-template or -organize-tv-template.
+// Placeholders: {title}, {year}, {season}, {episode} (two digits) and
+// {ext}.
+func libraryPath(info MediaInfo, ext string) string {
+	template := config.organizeMovieTemplate
+	if info.Episode > 0 {
+		template = config.organizeTVTemplate
+	}
+	year := ""
+	if info.Year > 0 {
+		year = strconv.Itoa(info.Year)
+	}
+	relPath := strings.NewReplacer(
+		"{title}", sanitizePathComponent(info.Title),
+		"{year}", year,
+		"{season}", fmt.Sprintf("%02d", info.Season),
+		"{episode}", fmt.Sprintf("%02d", info.Episode),
+		"{ext}", strings.ToLower(ext),
+	).Replace(template)
+	// " ()" is left behind by {year} when it's unknown
+	relPath = strings.Replace(relPath, " ()", "", -1)
+	return filepath.Join(config.organizeDir, filepath.FromSlash(relPath))
+}
+
+// matchingSubtitles returns the indexes of the subtitle files next to
+// video whose name starts with the video name, with the suffix to keep
+// (e.g. ".en.srt").
+func matchingSubtitles(files lt.FileStorage, numFiles int, video string) map[int]string {
+	ret := map[int]string{}
+	base := strings.TrimSuffix(path.Base(video), path.Ext(video))
+	dir := path.Dir(video)
+	for i := 0; i < numFiles; i++ {
+		name := filepath.ToSlash(originalFilePath(files, i))
+		if !hasExtension(name, subtitleExtensions) {
+			continue
+		}
+		subDir, subName := path.Dir(name), path.Base(name)
+		if strings.HasPrefix(subName, base) && (subDir == dir || path.Dir(subDir) == dir) {
+			ret[i] = subName[len(base):]
+		}
+	}
+	return ret
+}
+
+// organizeTorrent puts the completed videos of the main torrent and their
+// subtitles into -organize-dir.
+func organizeTorrent() {
+	if config.organizeDir == "" || torrentHandle == nil || torrentInfo == nil {
+		return
+	}
+	progresses := lt.NewStdVectorSizeType()
+	defer lt.DeleteStdVectorSizeType(progresses)
+	torrentHandle.FileProgress(progresses, int(lt.WrappedTorrentHandlePieceGranularity))
+
+	files := torrentInfo.Files()
+	numFiles := torrentInfo.NumFiles()
+	organized := 0
+	for i := 0; i < numFiles; i++ {
+		name := filepath.ToSlash(originalFilePath(files, i))
+		if !hasExtension(name, videoExtensions) || progresses.Get(i) != files.FileSize(i) || isOrganized(i) || renamePending(i) {
+			continue
+		}
+		info, ok := mediaInfoForFile(torrentInfo.Name(), name)
+		if !ok {
+			log.Printf("organizer: unable to parse %s", name)
+			continue
+		}
+		dest := libraryPath(info, path.Ext(name))
+		if err := organizeFile(i, dest); err != nil {
+			log.Printf("organizer: %s", err)
+			continue
+		}
+		organized++
+		destBase := strings.TrimSuffix(dest, filepath.Ext(dest))
+		for j, suffix := range matchingSubtitles(files, numFiles, name) {
+			if progresses.Get(j) != files.FileSize(j) || isOrganized(j) || renamePending(j) {
+				continue
+			}
+			if err := organizeFile(j, destBase+suffix); err != nil {
+				log.Printf("organizer: %s", err)
+			}
+		}
+	}
+	if organized > 0 {
+		saveLibraryEntries()
+	}
+}
+
+// organizeFile hardlinks or moves torrent file index to dest. Moves go
+// through libtorrent, so that the file can still be seeded, and are
+// recorded once libtorrent is done. An existing library file is never
+// replaced.
+func organizeFile(index int, dest string) error {
+	files := torrentInfo.Files()
+	original := originalFilePath(files, index)
+	source := fileDiskPath(files, index)
+	moved := config.organizeMode == "move"
+	if destInfo, err := os.Stat(dest); err == nil {
+		if sourceInfo, err := os.Stat(source); err == nil && !moved && os.SameFile(sourceInfo, destInfo) {
+			// linked by a previous run
+			addLibraryEntry(index, LibraryEntry{Original: original, Path: dest})
+			return nil
+		}
+		return fmt.Errorf("%s already exists, not replacing it with %s", dest, original)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if moved {
+		return requestRename(index, dest, func(message string) {
+			if message != "" {
+				log.Printf("organizer: unable to move %s to %s: %s", original, dest, message)
+				return
+			}
+			addLibraryEntry(index, LibraryEntry{Original: original, Path: dest, Moved: true})
+			saveLibraryEntries()
+		})
+	}
+	if err := os.Link(source, dest); err != nil {
+		return fmt.Errorf("unable to link %s to %s: %s", source, dest, err)
+	}
+	addLibraryEntry(index, LibraryEntry{Original: original, Path: dest})
+	return nil
+}
+
+func addLibraryEntry(index int, entry LibraryEntry) {
+	log.Printf("organizer: %s -> %s", entry.Original, entry.Path)
+	publishEvent("organized", "%s -> %s", entry.Original, entry.Path)
+	libraryLock.Lock()
+	libraryEntries[index] = entry
+	libraryLock.Unlock()
+}
+
+// hasMovedLibraryFiles tells whether files of the main torrent were moved
+// to -organize-dir, where libtorrent must not delete them.
+func hasMovedLibraryFiles() bool {
+	libraryLock.RLock()
+	defer libraryLock.RUnlock()
+	for _, entry := range libraryEntries {
+		if entry.Moved {
+			return true
+		}
+	}
+	return false
+}
+
+func isOrganized(index int) bool {
+	libraryLock.RLock()
+	defer libraryLock.RUnlock()
+	_, ok := libraryEntries[index]
+	return ok
+}
+
+func getLibraryEntry(index int) (LibraryEntry, bool) {
+	libraryLock.RLock()
+	defer libraryLock.RUnlock()
+	entry, ok := libraryEntries[index]
+	return entry, ok
+}
+
+// originalFilePath is the path of file index in the torrent, as served
+// by /files/, even after the organizer moved it elsewhere.
+func originalFilePath(files lt.FileStorage, index int) string {
+	if entry, ok := getLibraryEntry(index); ok && entry.Moved {
+		return entry.Original
+	}
+	return torrentFilePath(files, index)
+}
+
+// fileDiskPath is where file index is on disk.
+func fileDiskPath(files lt.FileStorage, index int) string {
+	if entry, ok := getLibraryEntry(index); ok && entry.Moved {
+		return entry.Path
+	}
+	if diskPath := files.FilePath(index); filepath.IsAbs(diskPath) {
+		// moved by a {file} -move-template
+		return diskPath
+	}
+	diskPath, _ := filepath.Abs(path.Join(getSavePath(), torrentFilePath(files, index)))
+	return diskPath
+}
+
+func loadLibrary() map[string]map[int]LibraryEntry {
+	library := map[string]map[int]LibraryEntry{}
+	data, err := ioutil.ReadFile(filepath.Join(config.organizeDir, libraryFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &library); err != nil {
+			log.Printf("unable to read organizer mapping: %s", err)
+		}
+	}
+	return library
+}
+
+// loadLibraryEntries restores the mapping of the main torrent recorded by
+// a previous run.
+func loadLibraryEntries() {
+	if config.organizeDir == "" {
+		return
+	}
+	entries := loadLibrary()[currentInfoHash()]
+	libraryLock.Lock()
+	defer libraryLock.Unlock()
+	for index, entry := range entries {
+		if _, err := os.Stat(entry.Path); err == nil {
+			libraryEntries[index] = entry
+		}
+	}
+}
+
+func saveLibraryEntries() {
+	library := loadLibrary()
+	libraryLock.RLock()
+	entries := map[int]LibraryEntry{}
+	for index, entry := range libraryEntries {
+		entries[index] = entry
+	}
+	libraryLock.RUnlock()
+	library[currentInfoHash()] = entries
+
+	data, _ := json.Marshal(library)
+	if err := ioutil.WriteFile(filepath.Join(config.organizeDir, libraryFile), data, 0644); err != nil {
+		log.Printf("unable to save organizer mapping: %s", err)
+	}
+}
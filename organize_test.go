@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMediaName(t *testing.T) {
+	tests := []struct {
+		name string
+		info MediaInfo
+		ok   bool
+	}{
+		{"Some.Movie.2004.1080p.BluRay.x264", MediaInfo{Title: "Some Movie", Year: 2004}, true},
+		{"Some Movie (1999) [720p]", MediaInfo{Title: "Some Movie", Year: 1999}, true},
+		{"Some.Show.S01E02.720p.HDTV", MediaInfo{Title: "Some Show", Season: 1, Episode: 2}, true},
+		{"Some_Show_s10e123", MediaInfo{Title: "Some Show", Season: 10, Episode: 123}, true},
+		{"Some Show - 1x02 - Pilot", MediaInfo{Title: "Some Show", Season: 1, Episode: 2}, true},
+		{"Some.Show.2005.S03E04", MediaInfo{Title: "Some Show", Year: 2005, Season: 3, Episode: 4}, true},
+		{"Some.Show.S02.1080p", MediaInfo{Title: "Some Show", Season: 2}, true},
+		{"Some Show Season 3", MediaInfo{Title: "Some Show", Season: 3}, true},
+		{"random_file_name", MediaInfo{}, false},
+		{"2004", MediaInfo{}, false},
+	}
+	for _, test := range tests {
+		info, ok := parseMediaName(test.name)
+		if ok != test.ok || (ok && info != test.info) {
+			t.Errorf("parseMediaName(%q) = %+v, %v, want %+v, %v", test.name, info, ok, test.info, test.ok)
+		}
+	}
+}
+
+func TestMediaInfoForFile(t *testing.T) {
+	tests := []struct {
+		torrentName string
+		filePath    string
+		info        MediaInfo
+		ok          bool
+	}{
+		{"Some.Movie.2004.1080p", "Some.Movie.2004.1080p/movie.mkv", MediaInfo{Title: "Some Movie", Year: 2004}, true},
+		{"Some.Show.S01.1080p", "Some.Show.S01.1080p/Some.Show.S01E02.mkv", MediaInfo{Title: "Some Show", Season: 1, Episode: 2}, true},
+		// the title from the directory, the episode from the file
+		{"Pack", "Pack/Some.Show.S01/Some Show 1x03.mkv", MediaInfo{Title: "Some Show", Season: 1, Episode: 3}, true},
+		{"Pack", "Pack/Some.Show.S01/02.mkv", MediaInfo{Title: "Some Show", Season: 1, Episode: 2}, true},
+		{"Some.Show.S01.1080p", "Some.Show.S01.1080p/E04 - Title.mkv", MediaInfo{Title: "Some Show", Season: 1, Episode: 4}, true},
+		// a season pack without episode numbers can't be placed
+		{"Some.Show.S01.1080p", "Some.Show.S01.1080p/episode.mkv", MediaInfo{}, false},
+		{"whatever", "whatever/video.mkv", MediaInfo{}, false},
+	}
+	for _, test := range tests {
+		info, ok := mediaInfoForFile(test.torrentName, test.filePath)
+		if ok != test.ok || (ok && info != test.info) {
+			t.Errorf("mediaInfoForFile(%q, %q) = %+v, %v, want %+v, %v",
+				test.torrentName, test.filePath, info, ok, test.info, test.ok)
+		}
+	}
+}
+
+func TestLibraryPath(t *testing.T) {
+	config.organizeDir = "library"
+	config.organizeMovieTemplate = "Movies/{title} ({year})/{title} ({year}){ext}"
+	config.organizeTVTemplate = "TV/{title}/Season {season}/{title} S{season}E{episode}{ext}"
+	tests := []struct {
+		info MediaInfo
+		ext  string
+		path string
+	}{
+		{MediaInfo{Title: "Some Movie", Year: 2004}, ".MKV", "library/Movies/Some Movie (2004)/Some Movie (2004).mkv"},
+		{MediaInfo{Title: "Some Movie"}, ".mkv", "library/Movies/Some Movie/Some Movie.mkv"},
+		{MediaInfo{Title: "Some Show", Season: 1, Episode: 2}, ".mp4", "library/TV/Some Show/Season 01/Some Show S01E02.mp4"},
+		{MediaInfo{Title: "AC/DC", Year: 1980}, ".mkv", "library/Movies/AC_DC (1980)/AC_DC (1980).mkv"},
+	}
+	for _, test := range tests {
+		if got := libraryPath(test.info, test.ext); got != filepath.FromSlash(test.path) {
+			t.Errorf("libraryPath(%+v, %q) = %q, want %q", test.info, test.ext, got, test.path)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+// libtorrent peer_info::flags
+const (
+	peerInteresting        = 0x1
+	peerChoked             = 0x2
+	peerRemoteInterested   = 0x4
+	peerRemoteChoked       = 0x8
+	peerSupportsExtension  = 0x10
+	peerLocalConnection    = 0x20
+	peerHandshake          = 0x40
+	peerConnecting         = 0x80
+	peerOnParole           = 0x200
+	peerSeed               = 0x400
+	peerOptimisticUnchoke  = 0x800
+	peerSnubbed            = 0x1000
+	peerUploadOnly         = 0x2000
+	peerEndgameMode        = 0x4000
+	peerHolepunched        = 0x8000
+	peerI2PSocket          = 0x10000
+	peerUTPSocket          = 0x20000
+	peerSSLSocket          = 0x40000
+	peerRC4Encrypted       = 0x100000
+	peerPlaintextEncrypted = 0x200000
+)
+
+var peerFlagNames = []struct {
+	flag uint
+	name string
+}{
+	{peerInteresting, "interesting"},
+	{peerChoked, "choked"},
+	{peerRemoteInterested, "remote_interested"},
+	{peerRemoteChoked, "remote_choked"},
+	{peerSupportsExtension, "supports_extensions"},
+	{peerLocalConnection, "outgoing"},
+	{peerHandshake, "handshake"},
+	{peerConnecting, "connecting"},
+	{peerOnParole, "on_parole"},
+	{peerSeed, "seed"},
+	{peerOptimisticUnchoke, "optimistic_unchoke"},
+	{peerSnubbed, "snubbed"},
+	{peerUploadOnly, "upload_only"},
+	{peerEndgameMode, "endgame_mode"},
+	{peerHolepunched, "holepunched"},
+	{peerI2PSocket, "i2p"},
+	{peerUTPSocket, "utp"},
+	{peerSSLSocket, "ssl"},
+	{peerRC4Encrypted, "rc4_encrypted"},
+	{peerPlaintextEncrypted, "plaintext_encrypted"},
+}
+
+// libtorrent peer_info::source
+var peerSourceNames = []struct {
+	flag uint
+	name string
+}{
+	{0x1, "tracker"},
+	{0x2, "dht"},
+	{0x4, "pex"},
+	{0x8, "lsd"},
+	{0x10, "resume_data"},
+	{0x20, "incoming"},
+}
+
+// libtorrent peer_info::connection_type
+const (
+	peerConnectionStandard = iota
+	peerConnectionWebSeed
+	peerConnectionHTTPSeed
+)
+
+// Peers are re-allowed this long after /peers/disconnect blocked them,
+// which gives libtorrent time to drop the connection.
+const disconnectFilterTime = 5 * time.Second
+
+func peerFlags(flags uint) []string {
+	names := []string{}
+	for _, f := range peerFlagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+func peerSources(source uint) []string {
+	names := []string{}
+	for _, s := range peerSourceNames {
+		if source&s.flag != 0 {
+			names = append(names, s.name)
+		}
+	}
+	return names
+}
+
+func peerConnectionType(peer lt.PeerInfo) string {
+	switch peer.GetConnectionType() {
+	case peerConnectionWebSeed:
+		return "web_seed"
+	case peerConnectionHTTPSeed:
+		return "http_seed"
+	}
+	flags := peer.GetFlags()
+	if flags&peerI2PSocket != 0 {
+		return "i2p"
+	}
+	if flags&peerUTPSocket != 0 {
+		return "utp"
+	}
+	return "tcp"
+}
+
+func peerEncryption(flags uint) string {
+	if flags&peerRC4Encrypted != 0 {
+		return "rc4"
+	}
+	if flags&peerPlaintextEncrypted != 0 {
+		return "plaintext"
+	}
+	return "none"
+}
+
+func peersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		addr := r.FormValue("addr")
+		if addr == "" {
+			http.Error(w, "addr param missing", http.StatusBadRequest)
+			return
+		}
+		log.Printf("connecting to peer: %s", addr)
+		if err := connectPeer(torrentHandle, addr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "GET":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	listPeers(w)
+}
+
+func listPeers(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ret := PeersInfo{Peers: collectPeers()}
+
+	output, _ := json.Marshal(ret)
+	w.Write(output)
+}
+
+func collectPeers() []PeerInfo {
+	var peers []PeerInfo
+
+	vectorPeerInfo := lt.NewStdVectorPeerInfo()
+	defer lt.DeleteStdVectorPeerInfo(vectorPeerInfo)
+	torrentHandle.GetPeerInfo(vectorPeerInfo)
+	for i := 0; i < int(vectorPeerInfo.Size()); i++ {
+		peer := vectorPeerInfo.Get(i)
+		flags := peer.GetFlags()
+		ip := fmt.Sprint(peer.GetIp())
+		country, asn, asOrg := lookupGeoIP(peerIP(ip))
+		pi := PeerInfo{
+			Ip:             ip,
+			Flags:          flags,
+			FlagNames:      peerFlags(flags),
+			Source:         peer.GetSource(),
+			SourceNames:    peerSources(peer.GetSource()),
+			ConnectionType: peerConnectionType(peer),
+			Encryption:     peerEncryption(flags),
+			Progress:       peer.GetProgress(),
+			Rtt:            peer.GetRtt(),
+			UpSpeed:        float32(peer.GetUpSpeed()) / 1024,
+			DownSpeed:      float32(peer.GetDownSpeed()) / 1024,
+			TotalDownload:  peer.GetTotalDownload(),
+			TotalUpload:    peer.GetTotalUpload(),
+			Country:        country,
+			Asn:            asn,
+			AsOrg:          asOrg,
+			Client:         peer.GetClient(),
+		}
+		peers = append(peers, pi)
+	}
+	return peers
+}
+
+type BannedInfo struct {
+	Banned []string `json:"banned"`
+}
+
+// banHandler lists (GET), adds (POST) or lifts (DELETE) session bans
+// given by ?ip= as an address, CIDR block or first-last range.
+func banHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" || r.Method == "DELETE" {
+		ipRange, err := parseIPRange(r.FormValue("ip"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Method == "POST" {
+			banIPRange(ipRange)
+		} else if !unbanIPRange(ipRange) {
+			http.Error(w, "no such ban", http.StatusNotFound)
+			return
+		}
+	} else if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	ret := BannedInfo{Banned: []string{}}
+	ipFilterLock.Lock()
+	for _, banned := range bannedRanges {
+		ret.Banned = append(ret.Banned, banned.String())
+	}
+	ipFilterLock.Unlock()
+	output, _ := json.Marshal(ret)
+	w.Write(output)
+}
+
+// disconnectHandler drops the connection to the peer given by ?ip=.
+// libtorrent 1.2 can't close a single peer connection from the outside,
+// so the address is briefly added to the session IP filter instead, along
+// with the blocklist and bans. The filter is session-wide: the peer is
+// dropped by, and kept out of, every torrent for disconnectFilterTime.
+func disconnectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := r.FormValue("ip")
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	ipRange, err := parseIPRange(ip)
+	if err != nil || !ipRange.First.Equal(ipRange.Last) {
+		http.Error(w, "ip must be a single address", http.StatusBadRequest)
+		return
+	}
+	log.Printf("disconnecting peer %s", ip)
+	disconnectIPRange(ipRange, disconnectFilterTime)
+	fmt.Fprintf(w, "Peer %s disconnected, blocked in every torrent for %s", ip, disconnectFilterTime)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+const (
+	defaultI2PSAMPort  = 7656
+	proxyCheckInterval = time.Minute
+	proxyCheckTimeout  = 10 * time.Second
+)
+
+// ProxyConfig is the parsed form of -proxy.
+type ProxyConfig struct {
+	Type     int
+	Host     string
+	Port     int
+	Username string
+	Password string
+	URL      *url.URL
+}
+
+var (
+	proxyConfig    *ProxyConfig
+	proxyStateLock sync.Mutex
+	proxyState     string
+	proxyError     string
+)
+
+// parseProxy parses socks4://, socks5://, http:// and i2p:// proxy URLs,
+// with optional user:pass@ credentials.
+func parseProxy(proxy string) (*ProxyConfig, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	pc := &ProxyConfig{Host: proxyURL.Hostname(), URL: proxyURL}
+	if pc.Host == "" {
+		return nil, fmt.Errorf("proxy host missing in %s", proxy)
+	}
+	if proxyURL.User != nil {
+		pc.Username = proxyURL.User.Username()
+		pc.Password, _ = proxyURL.User.Password()
+	}
+	withAuth := pc.Username != ""
+
+	defaultPort := 0
+	switch proxyURL.Scheme {
+	case "socks4":
+		pc.Type = ProxyTypeSocks4
+		defaultPort = 1080
+	case "socks5", "socks5h":
+		pc.Type = ProxyTypeSocks5
+		if withAuth {
+			pc.Type = ProxyTypeSocks5Password
+		}
+		defaultPort = 1080
+	case "http":
+		pc.Type = ProxyTypeSocksHTTP
+		if withAuth {
+			pc.Type = ProxyTypeSocksHTTPPassword
+		}
+		defaultPort = 8080
+	case "i2p":
+		pc.Type = ProxyTypeI2PSAM
+		defaultPort = defaultI2PSAMPort
+	default:
+		return nil, fmt.Errorf("unsupported proxy type: %s", proxyURL.Scheme)
+	}
+
+	pc.Port = defaultPort
+	if portStr := proxyURL.Port(); portStr != "" {
+		if pc.Port, err = strconv.Atoi(portStr); err != nil {
+			return nil, fmt.Errorf("invalid proxy port: %s", portStr)
+		}
+	}
+	return pc, nil
+}
+
+// String returns the proxy URL without the password.
+func (pc *ProxyConfig) String() string {
+	u := *pc.URL
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	return u.String()
+}
+
+func (pc *ProxyConfig) address() string {
+	return net.JoinHostPort(pc.Host, strconv.Itoa(pc.Port))
+}
+
+// setProxySettings configures libtorrent for -proxy.
+func setProxySettings(settings lt.SettingsPack) {
+	if proxyConfig == nil {
+		settings.SetInt("proxy_type", ProxyTypeNone)
+		return
+	}
+	log.Printf("using proxy: %s", proxyConfig)
+	if proxyConfig.Type == ProxyTypeI2PSAM {
+		settings.SetStr("i2p_hostname", proxyConfig.Host)
+		settings.SetInt("i2p_port", proxyConfig.Port)
+		settings.SetBool("allow_i2p_mixed", true)
+		settings.SetInt("proxy_type", ProxyTypeNone)
+		return
+	}
+	settings.SetInt("proxy_type", proxyConfig.Type)
+	settings.SetStr("proxy_hostname", proxyConfig.Host)
+	settings.SetInt("proxy_port", proxyConfig.Port)
+	settings.SetStr("proxy_username", proxyConfig.Username)
+	settings.SetStr("proxy_password", proxyConfig.Password)
+	settings.SetBool("proxy_peer_connections", config.proxyPeers)
+	settings.SetBool("proxy_tracker_connections", config.proxyTrackers)
+	settings.SetBool("proxy_hostnames", config.proxyHostnames)
+}
+
+// proxyTransport returns an HTTP transport going through -proxy for the
+// Go side downloads (.torrent files, tracker lists, blocklists), or nil
+// if they should connect directly. Proxies net/http can't use make every
+// request fail rather than leak the real address.
+func proxyTransport() *http.Transport {
+	if proxyConfig == nil || !config.proxyTrackers {
+		return nil
+	}
+	switch proxyConfig.Type {
+	case ProxyTypeSocks4, ProxyTypeI2PSAM:
+		err := fmt.Errorf("%s proxy can't be used for HTTP downloads, use -proxy-trackers=false to download directly", proxyConfig.URL.Scheme)
+		return &http.Transport{Proxy: func(*http.Request) (*url.URL, error) {
+			return nil, err
+		}}
+	}
+	proxyURL := *proxyConfig.URL
+	if proxyURL.Scheme == "socks5h" {
+		proxyURL.Scheme = "socks5"
+	}
+	return &http.Transport{Proxy: http.ProxyURL(&proxyURL)}
+}
+
+func setProxyState(state string, err string) {
+	proxyStateLock.Lock()
+	defer proxyStateLock.Unlock()
+	if state != proxyState || err != proxyError {
+		if err != "" {
+			log.Printf("proxy %s: %s", state, err)
+		} else {
+			log.Printf("proxy %s", state)
+		}
+	}
+	proxyState = state
+	proxyError = err
+}
+
+// setI2PError records an error of the I2P SAM session, reported until a
+// SAM handshake of monitorProxy succeeds.
+func setI2PError(err string) {
+	setProxyState("error", err)
+}
+
+func getProxyState() (string, string) {
+	proxyStateLock.Lock()
+	defer proxyStateLock.Unlock()
+	return proxyState, proxyError
+}
+
+// monitorProxy periodically checks that the proxy accepts connections,
+// since libtorrent only reports proxy failures as generic peer and
+// tracker errors. An I2P SAM bridge must also answer the handshake.
+func monitorProxy() {
+	for {
+		conn, err := net.DialTimeout("tcp", proxyConfig.address(), proxyCheckTimeout)
+		if err != nil {
+			setProxyState("unreachable", err.Error())
+		} else {
+			if proxyConfig.Type == ProxyTypeI2PSAM {
+				err = samHello(conn)
+			}
+			conn.Close()
+			if err != nil {
+				setProxyState("error", err.Error())
+			} else {
+				setProxyState("reachable", "")
+			}
+		}
+		time.Sleep(proxyCheckInterval)
+	}
+}
+
+// samHello performs the handshake of the SAM bridge on conn.
+func samHello(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(proxyCheckTimeout))
+	if _, err := fmt.Fprintf(conn, "HELLO VERSION MIN=3.0 MAX=3.1\n"); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(reply, "HELLO REPLY RESULT=OK") {
+		return fmt.Errorf("SAM handshake failed: %s", strings.TrimSpace(reply))
+	}
+	return nil
+}
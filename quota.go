@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+	"github.com/shirou/gopsutil/disk"
+)
+
+const (
+	// keptTorrentsFile lists the torrents left in -dl-path, for eviction.
+	keptTorrentsFile  = ".torrent2http-kept.json"
+	diskQuotaInterval = time.Minute
+)
+
+// KeptTorrent is a torrent whose files stay in -dl-path after exiting.
+type KeptTorrent struct {
+	Name         string   `json:"name"`
+	SavePath     string   `json:"save_path"`
+	Paths        []string `json:"paths"`
+	ResumeFile   string   `json:"resume_file"`
+	LastStreamed int64    `json:"last_streamed"`
+}
+
+var (
+	keptTorrentsLock sync.Mutex
+	diskLock         sync.Mutex
+	diskError        string
+	// diskPaused is set while the torrent is paused for lack of space.
+	diskPaused bool
+)
+
+func keepingFiles() bool {
+	return config.keepFiles || config.keepComplete || config.keepIncomplete
+}
+
+func keptTorrentsPath() string {
+	return filepath.Join(getDownloadPath(), keptTorrentsFile)
+}
+
+func loadKeptTorrents() map[string]*KeptTorrent {
+	kept := map[string]*KeptTorrent{}
+	data, err := ioutil.ReadFile(keptTorrentsPath())
+	if err != nil {
+		return kept
+	}
+	if err := json.Unmarshal(data, &kept); err != nil {
+		log.Printf("unable to read %s: %s", keptTorrentsPath(), err)
+	}
+	return kept
+}
+
+func saveKeptTorrents(kept map[string]*KeptTorrent) {
+	data, _ := json.Marshal(kept)
+	if err := ioutil.WriteFile(keptTorrentsPath(), data, 0644); err != nil {
+		log.Printf("unable to save %s: %s", keptTorrentsPath(), err)
+	}
+}
+
+func currentInfoHash() string {
+	status := torrentHandle.Status()
+	defer lt.DeleteTorrentStatus(status)
+	return hex.EncodeToString([]byte(status.GetInfoHash().ToString()))
+}
+
+// recordKeptTorrent adds the current torrent to the kept torrents list,
+// with the top level files and directories it owns in -dl-path.
+func recordKeptTorrent() {
+	if !keepingFiles() || torrentInfo == nil {
+		return
+	}
+	files := torrentInfo.Files()
+	seen := map[string]bool{}
+	var paths []string
+	for i := 0; i < torrentInfo.NumFiles(); i++ {
+		top := strings.SplitN(filepath.ToSlash(torrentFilePath(files, i)), "/", 2)[0]
+		if !seen[top] {
+			seen[top] = true
+			paths = append(paths, top)
+		}
+	}
+
+	keptTorrentsLock.Lock()
+	defer keptTorrentsLock.Unlock()
+	kept := loadKeptTorrents()
+	kept[currentInfoHash()] = &KeptTorrent{
+		Name:         torrentInfo.Name(),
+		SavePath:     getSavePath(),
+		Paths:        paths,
+		ResumeFile:   getResumeFile(),
+		LastStreamed: time.Now().Unix(),
+	}
+	saveKeptTorrents(kept)
+}
+
+// touchKeptTorrent marks the current torrent as just streamed.
+func touchKeptTorrent() {
+	if !keepingFiles() || torrentHandle == nil {
+		return
+	}
+	keptTorrentsLock.Lock()
+	defer keptTorrentsLock.Unlock()
+	kept := loadKeptTorrents()
+	if entry, ok := kept[currentInfoHash()]; ok {
+		entry.LastStreamed = time.Now().Unix()
+		saveKeptTorrents(kept)
+	}
+}
+
+// dirSize is the disk space used by path, which is less than the size of
+// sparse files being downloaded.
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += diskUsage(info)
+		}
+		return nil
+	})
+	return size
+}
+
+// activeInfoHashes returns the info-hashes of the torrents in the session,
+// which must not be evicted.
+func activeInfoHashes() map[string]bool {
+	active := map[string]bool{}
+	torrents := session.GetTorrents()
+	defer lt.DeleteStdVectorTorrentHandle(torrents)
+	for i := 0; i < int(torrents.Size()); i++ {
+		active[hex.EncodeToString([]byte(torrents.Get(i).InfoHash().ToString()))] = true
+	}
+	return active
+}
+
+// sessionPaths returns the top level files and directories of the
+// torrents in the session. A kept torrent may have used the same names
+// (same release, another info-hash), eviction must leave them alone.
+func sessionPaths() []string {
+	var paths []string
+	torrents := session.GetTorrents()
+	defer lt.DeleteStdVectorTorrentHandle(torrents)
+	for i := 0; i < int(torrents.Size()); i++ {
+		handle := torrents.Get(i)
+		status := handle.Status()
+		savePath := status.GetSavePath()
+		names := []string{status.GetName()}
+		if status.GetHasMetadata() {
+			info := handle.TorrentFile()
+			files := info.Files()
+			for j := 0; j < info.NumFiles(); j++ {
+				names = append(names, strings.SplitN(filepath.ToSlash(files.FilePath(j)), "/", 2)[0])
+			}
+		}
+		lt.DeleteTorrentStatus(status)
+		for _, name := range names {
+			if name != "" {
+				fullPath, _ := filepath.Abs(filepath.Join(savePath, name))
+				paths = append(paths, fullPath)
+			}
+		}
+	}
+	return paths
+}
+
+// pathsOverlap tells whether a and b are the same path or one contains
+// the other.
+func pathsOverlap(a string, b string) bool {
+	sep := string(filepath.Separator)
+	return a == b || strings.HasPrefix(a, b+sep) || strings.HasPrefix(b, a+sep)
+}
+
+// evictable tells whether fullPath, a path of a kept torrent, may be
+// deleted: it must be strictly inside base and not hold, nor be inside, a
+// path in use. All the paths are absolute.
+func evictable(fullPath string, base string, inUse []string) bool {
+	if !strings.HasPrefix(fullPath, filepath.Clean(base)+string(filepath.Separator)) {
+		return false
+	}
+	for _, used := range inUse {
+		if pathsOverlap(fullPath, used) {
+			log.Printf("not evicting %s, used by a torrent in the session", fullPath)
+			return false
+		}
+	}
+	return true
+}
+
+// evictKeptTorrents deletes the least recently streamed kept torrents and
+// their resume files until at least bytes are freed. Returns the number
+// of bytes freed.
+func evictKeptTorrents(bytes int64) int64 {
+	keptTorrentsLock.Lock()
+	defer keptTorrentsLock.Unlock()
+
+	kept := loadKeptTorrents()
+	active := activeInfoHashes()
+	inUse := sessionPaths()
+	var hashes []string
+	for hash := range kept {
+		if !active[hash] {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return kept[hashes[i]].LastStreamed < kept[hashes[j]].LastStreamed
+	})
+
+	var freed int64
+	for _, hash := range hashes {
+		if freed >= bytes {
+			break
+		}
+		entry := kept[hash]
+		base := entry.SavePath
+		if base == "" {
+			base = getDownloadPath()
+		}
+		base, _ = filepath.Abs(base)
+		removed := true
+		for _, p := range entry.Paths {
+			fullPath := filepath.Join(base, p)
+			if !evictable(fullPath, base, inUse) {
+				removed = false
+				continue
+			}
+			size := dirSize(fullPath)
+			if err := os.RemoveAll(fullPath); err != nil {
+				log.Printf("unable to remove %s: %s", fullPath, err)
+				removed = false
+				continue
+			}
+			freed += size
+		}
+		if !removed {
+			// kept in the list, with its resume data, until its files are gone
+			continue
+		}
+		// the same path may be reused for the current torrent
+		if entry.ResumeFile != getResumeFile() {
+			removeResumeFile(entry.ResumeFile)
+		}
+		delete(kept, hash)
+		log.Printf("evicted %s (%s)", entry.Name, hash)
+		publishEvent("evicted", "%s (%s)", entry.Name, hash)
+	}
+	saveKeptTorrents(kept)
+	return freed
+}
+
+// ensureDiskSpace makes room for needed more bytes in -dl-path, both
+// within -max-disk-usage and on the disk itself, evicting kept torrents
+// if necessary.
+func ensureDiskSpace(needed int64) error {
+	if config.maxDiskUsage > 0 {
+		quota := int64(config.maxDiskUsage) * 1024 * 1024
+		usage := dirSize(getDownloadPath())
+		if over := usage + needed - quota; over > 0 {
+			if freed := evictKeptTorrents(over); freed < over {
+				return fmt.Errorf("-max-disk-usage exceeded: %d MB used, %d MB needed",
+					usage/1024/1024, needed/1024/1024)
+			}
+		}
+	}
+	usage, err := disk.Usage(getDownloadPath())
+	if err != nil {
+		log.Printf("unable to get free disk space: %s", err)
+		return nil
+	}
+	if missing := needed - int64(usage.Free); missing > 0 {
+		if freed := evictKeptTorrents(missing); freed < missing {
+			return fmt.Errorf("not enough disk space: %d MB free, %d MB needed",
+				usage.Free/1024/1024, needed/1024/1024)
+		}
+	}
+	return nil
+}
+
+// neededBytes is what is left to download of the files with a non-zero
+// priority in priorities.
+func neededBytes(priority func(int) int) int64 {
+	progresses := lt.NewStdVectorSizeType()
+	defer lt.DeleteStdVectorSizeType(progresses)
+	torrentHandle.FileProgress(progresses, int(lt.WrappedTorrentHandlePieceGranularity))
+
+	files := torrentInfo.Files()
+	var needed int64
+	for i := 0; i < torrentInfo.NumFiles(); i++ {
+		if priority(i) > 0 {
+			needed += files.FileSize(i) - progresses.Get(i)
+		}
+	}
+	return needed
+}
+
+// setDiskError records the error shown by /status, reporting whether it
+// changed.
+func setDiskError(err string) bool {
+	diskLock.Lock()
+	defer diskLock.Unlock()
+	changed := err != diskError
+	diskError = err
+	return changed
+}
+
+func getDiskError() string {
+	diskLock.Lock()
+	defer diskLock.Unlock()
+	return diskError
+}
+
+// checkDiskSpace reports whether the files selected by priority fit,
+// recording the error for /status.
+func checkDiskSpace(priority func(int) int) bool {
+	if err := ensureDiskSpace(neededBytes(priority)); err != nil {
+		if setDiskError(err.Error()) {
+			log.Println(err)
+			publishEvent("disk_full", "%s", err)
+		}
+		return false
+	}
+	setDiskError("")
+	return true
+}
+
+// pauseForDiskSpace pauses the torrent until the files it downloads fit.
+func pauseForDiskSpace() {
+	torrentHandle.AutoManaged(false)
+	torrentHandle.Pause()
+	diskLock.Lock()
+	waiting := diskPaused
+	diskPaused = true
+	diskLock.Unlock()
+	if !waiting {
+		go resumeOnDiskSpace()
+	}
+}
+
+// resumeOnDiskSpace checks the space again every diskQuotaInterval and
+// resumes the torrent paused by pauseForDiskSpace once its files fit,
+// e.g. after other files were deleted.
+func resumeOnDiskSpace() {
+	for {
+		time.Sleep(diskQuotaInterval)
+		if torrentHandle == nil {
+			return
+		}
+		if checkDiskSpace(func(i int) int { return torrentHandle.FilePriority(i).(int) }) {
+			break
+		}
+	}
+	diskLock.Lock()
+	diskPaused = false
+	diskLock.Unlock()
+	log.Println("enough disk space, resuming the torrent")
+	publishEvent("disk_available", "torrent resumed")
+	torrentHandle.AutoManaged(true)
+	torrentHandle.Resume()
+}
+
+// enforceDiskQuota keeps -dl-path within -max-disk-usage while torrents
+// are downloading.
+func enforceDiskQuota() {
+	for {
+		if err := ensureDiskSpace(0); err != nil && setDiskError(err.Error()) {
+			log.Println(err)
+		}
+		time.Sleep(diskQuotaInterval)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestEvictable(t *testing.T) {
+	base := filepath.FromSlash("/data/dl")
+	inUse := []string{filepath.FromSlash("/data/dl/Current"), filepath.FromSlash("/data/dl/Pack/Current")}
+	tests := []struct {
+		path      string
+		evictable bool
+	}{
+		{"/data/dl/Old Movie", true},
+		{"/data/dl/Old/Nested", true},
+		{"/data/dl", false},
+		{"/data", false},
+		{"/data/dl2/Old", false},
+		{"/elsewhere/Old", false},
+		// in use, or holding or inside a path in use
+		{"/data/dl/Current", false},
+		{"/data/dl/Current/file.mkv", false},
+		{"/data/dl/Pack", false},
+		{"/data/dl/Current2", true},
+	}
+	for _, test := range tests {
+		if got := evictable(filepath.FromSlash(test.path), base, inUse); got != test.evictable {
+			t.Errorf("evictable(%q, %q) = %v, want %v", test.path, base, got, test.evictable)
+		}
+	}
+}
+
+func TestPathsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"/a/b", "/a/b", true},
+		{"/a/b", "/a/b/c", true},
+		{"/a/b/c", "/a/b", true},
+		{"/a/b", "/a/bc", false},
+		{"/a/b", "/a/c", false},
+	}
+	for _, test := range tests {
+		if got := pathsOverlap(filepath.FromSlash(test.a), filepath.FromSlash(test.b)); got != test.overlap {
+			t.Errorf("pathsOverlap(%q, %q) = %v, want %v", test.a, test.b, got, test.overlap)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+const renameTimeout = 15 * time.Second
+
+var (
+	renameLock sync.Mutex
+	// renamedFiles holds the paths, relative to the save path, of the files
+	// renamed by /files/<index>/rename or -sanitize-names.
+	renamedFiles = map[int]string{}
+	// pendingRenames are the renames libtorrent is working on; the channel
+	// gets "" or the error once it's done.
+	pendingRenames = map[int]pendingRename{}
+
+	unsafeNameRe = regexp.MustCompile(`[<>:"|?*\\\x00-\x1f]`)
+)
+
+type pendingRename struct {
+	// done gets "" or the error once libtorrent is done.
+	done func(message string)
+}
+
+// torrentFilePath is the path of file index relative to the save path,
+// after renames.
+func torrentFilePath(files lt.FileStorage, index int) string {
+	renameLock.Lock()
+	defer renameLock.Unlock()
+	if name, ok := renamedFiles[index]; ok {
+		return name
+	}
+	if name, ok := movedFilePath(files, index); ok {
+		return name
+	}
+	return files.FilePath(index)
+}
+
+// cleanRelativePath validates a new file path, which must stay inside the
+// save path.
+func cleanRelativePath(name string) (string, error) {
+	name = path.Clean(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == "" || path.IsAbs(name) || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", errors.New("invalid path: " + name)
+	}
+	return name, nil
+}
+
+// requestRename asks libtorrent to rename file index to newPath, relative
+// to the save path or absolute. done is called from the alert loop once
+// it's done.
+func requestRename(index int, newPath string, done func(message string)) error {
+	renameLock.Lock()
+	if _, ok := pendingRenames[index]; ok {
+		renameLock.Unlock()
+		return fmt.Errorf("file %d is already being renamed", index)
+	}
+	pendingRenames[index] = pendingRename{done: done}
+	renameLock.Unlock()
+
+	torrentHandle.RenameFile(index, filepath.FromSlash(newPath))
+	return nil
+}
+
+func renamePending(index int) bool {
+	renameLock.Lock()
+	defer renameLock.Unlock()
+	_, ok := pendingRenames[index]
+	return ok
+}
+
+// startRename renames file index to newPath inside the save path,
+// returning the channel notified once it's done.
+func startRename(index int, newPath string) (chan string, error) {
+	files := torrentInfo.Files()
+	for i := 0; i < torrentInfo.NumFiles(); i++ {
+		if i != index && filepath.ToSlash(originalFilePath(files, i)) == newPath {
+			return nil, fmt.Errorf("file %d is already named %s", i, newPath)
+		}
+	}
+	done := make(chan string, 1)
+	err := requestRename(index, newPath, func(message string) {
+		if message == "" {
+			renameLock.Lock()
+			renamedFiles[index] = newPath
+			renameLock.Unlock()
+			publishEvent("file_renamed", "%d: %s", index, newPath)
+		}
+		done <- message
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+func popPendingRename(handle lt.TorrentHandle, index int) (pendingRename, bool) {
+	if !isMainTorrent(handle) {
+		return pendingRename{}, false
+	}
+	renameLock.Lock()
+	defer renameLock.Unlock()
+	pending, ok := pendingRenames[index]
+	delete(pendingRenames, index)
+	return pending, ok
+}
+
+// onFileRenamed completes a rename started by requestRename.
+func onFileRenamed(handle lt.TorrentHandle, index int, name string) {
+	if pending, ok := popPendingRename(handle, index); ok {
+		pending.done("")
+	}
+}
+
+func onFileRenameFailed(handle lt.TorrentHandle, index int, message string) {
+	if pending, ok := popPendingRename(handle, index); ok {
+		log.Printf("unable to rename file %d: %s", index, message)
+		publishEvent("file_rename_failed", "%d: %s", index, message)
+		pending.done(message)
+	}
+}
+
+// renameHandler handles POST /files/<index>/rename?name=<new path>, and
+// answers once libtorrent has renamed the file.
+func renameHandler(w http.ResponseWriter, r *http.Request, index int) {
+	newPath, err := cleanRelativePath(r.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if entry, ok := getLibraryEntry(index); ok && entry.Moved {
+		http.Error(w, "file was moved to "+entry.Path, http.StatusConflict)
+		return
+	}
+	if movedPath := torrentInfo.Files().FilePath(index); filepath.IsAbs(movedPath) {
+		http.Error(w, "file was moved to "+movedPath, http.StatusConflict)
+		return
+	}
+	done, err := startRename(index, newPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	select {
+	case message := <-done:
+		if message != "" {
+			http.Error(w, "unable to rename: "+message, http.StatusInternalServerError)
+			return
+		}
+	case <-time.After(renameTimeout):
+		http.Error(w, "rename still in progress", http.StatusGatewayTimeout)
+		return
+	}
+	saveResumeData(true)
+	fmt.Fprintf(w, "file %d renamed to %s", index, newPath)
+}
+
+// sanitizeFileName replaces the characters players and filesystems choke
+// on, and the trailing dots and spaces Windows drops, in each component.
+func sanitizeFileName(name string) string {
+	parts := strings.Split(filepath.ToSlash(name), "/")
+	for i, part := range parts {
+		part = unsafeNameRe.ReplaceAllString(part, "_")
+		part = strings.TrimRight(strings.TrimSpace(part), ".")
+		if part == "" {
+			part = "_"
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, "/")
+}
+
+// sanitizeFileNames renames the files with unsafe names, with
+// -sanitize-names.
+func sanitizeFileNames() {
+	if !config.sanitizeNames {
+		return
+	}
+	files := torrentInfo.Files()
+	for i := 0; i < torrentInfo.NumFiles(); i++ {
+		if filepath.IsAbs(files.FilePath(i)) {
+			// moved out of the save path
+			continue
+		}
+		name := filepath.ToSlash(torrentFilePath(files, i))
+		clean := sanitizeFileName(name)
+		if clean == name {
+			continue
+		}
+		log.Printf("renaming %s to %s", name, clean)
+		if _, err := startRename(i, clean); err != nil {
+			log.Printf("unable to rename %s: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+const (
+	resumeFileExt = ".fastresume"
+	// resumePieceBatch is the number of pieces downloaded between two
+	// saves of the resume data.
+	resumePieceBatch = 50
+	// resumeSaveInterval is the fallback for what no event covers, like
+	// the upload totals.
+	resumeSaveInterval = 5 * time.Minute
+)
+
+var (
+	resumeLock sync.Mutex
+	// resumeFile is where the resume data of the main torrent is saved:
+	// -resume-file, or <info-hash>.fastresume in -resume-dir.
+	resumeFile string
+	// resumePieces is the number of pieces the main torrent had at the
+	// last save.
+	resumePieces = -1
+	// resumeStopped is set on shutdown, when only saveResumeDataOnExit
+	// saves the resume data.
+	resumeStopped bool
+)
+
+// resumeDir returns -resume-dir, relative to -dl-path unless absolute, or
+// "" when disabled.
+func resumeDir() string {
+	if config.resumeDir == "" {
+		return ""
+	}
+	if filepath.IsAbs(config.resumeDir) {
+		return config.resumeDir
+	}
+	return filepath.Join(getDownloadPath(), config.resumeDir)
+}
+
+func defaultResumeFile(infoHash string) string {
+	if resumeDir() == "" || infoHash == "" {
+		return ""
+	}
+	return filepath.Join(resumeDir(), infoHash+resumeFileExt)
+}
+
+func getResumeFile() string {
+	resumeLock.Lock()
+	defer resumeLock.Unlock()
+	return resumeFile
+}
+
+// initResumeFile picks the resume file of the main torrent once added.
+func initResumeFile() {
+	path := config.resumeFile
+	if path == "" {
+		path = defaultResumeFile(currentInfoHash())
+	}
+	resumeLock.Lock()
+	resumeFile = path
+	resumeLock.Unlock()
+	if path != "" {
+		log.Printf("resume data will be saved to: %s", path)
+	}
+}
+
+func validResumeData(data []byte) bool {
+	dict, _, err := bdecodeDict(data)
+	return err == nil && bencodeString(dict, "file-format") == "libtorrent resume file"
+}
+
+// readResumeData reads path, falling back to the backup left by the
+// previous save if it's missing or corrupt. It returns nil when there is
+// no resume data yet.
+func readResumeData(path string) ([]byte, error) {
+	found := false
+	for _, p := range []string{path, path + ".bak"} {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println(err)
+			}
+			continue
+		}
+		found = true
+		if !validResumeData(data) {
+			log.Printf("discarding corrupt resume data: %s", p)
+			continue
+		}
+		if p != path {
+			log.Printf("using resume data backup: %s", p)
+		}
+		return data, nil
+	}
+	if !found {
+		return nil, nil
+	}
+	return nil, errors.New("no valid resume data in " + path)
+}
+
+// writeResumeData replaces path atomically, keeping the previous resume
+// data as path.bak. readResumeData falls back to it if path is missing.
+func writeResumeData(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, path+".bak"); err != nil {
+			log.Printf("unable to back up resume data: %s", err)
+		}
+	}
+	return writeFileAtomic(path, data)
+}
+
+func removeResumeFile(path string) {
+	if path == "" {
+		return
+	}
+	for _, p := range []string{path, path + ".bak", path + ".tmp"} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Printf("error deleting resume file: %s", err)
+		}
+	}
+}
+
+// requestResumeSave asks libtorrent for the resume data of the main
+// torrent after a change worth keeping.
+func requestResumeSave(reason string) {
+	if torrentHandle == nil || getResumeFile() == "" || resumeEventsStopped() {
+		return
+	}
+	if saveResumeData(true) && config.debugAlerts {
+		log.Printf("saving resume data: %s", reason)
+	}
+}
+
+// checkResumePieces saves the resume data every resumePieceBatch pieces.
+func checkResumePieces(status lt.TorrentStatus) {
+	pieces := status.GetNumPieces()
+	resumeLock.Lock()
+	if resumePieces < 0 || pieces < resumePieces {
+		resumePieces = pieces
+	}
+	save := pieces-resumePieces >= resumePieceBatch
+	if save {
+		resumePieces = pieces
+	}
+	resumeLock.Unlock()
+	if save {
+		requestResumeSave("pieces downloaded")
+	}
+}
+
+// onResumeEvent saves the resume data of the main torrent when it's
+// paused, finished, moved or rechecked.
+func onResumeEvent(handle lt.TorrentHandle, event string) {
+	if isMainTorrent(handle) {
+		requestResumeSave(event)
+	}
+}
+
+func resumeEventsStopped() bool {
+	resumeLock.Lock()
+	defer resumeLock.Unlock()
+	return resumeStopped
+}
+
+// stopResumeEvents stops the saves on events, e.g. the torrent_paused_alert
+// of shutdown: saveResumeDataOnExit would otherwise find nothing to save
+// while the alert of the async save is never processed.
+func stopResumeEvents() {
+	resumeLock.Lock()
+	resumeStopped = true
+	resumeLock.Unlock()
+}
+
+// saveResumeDataOnExit saves the resume data of the main torrent and
+// waits for it, even if libtorrent thinks nothing changed since an async
+// save that may still be in flight.
+func saveResumeDataOnExit() {
+	if forceshutdelete || getResumeFile() == "" {
+		return
+	}
+	torrentHandle.SaveResumeData(3)
+	// processAlert writes it
+	if waitForAlert("save_resume_data_alert", 5*time.Second) == nil {
+		log.Println("timed out saving resume data")
+	}
+}
+
+// cleanupResumeFile removes the default resume file on exit when the
+// files of the torrent are not kept.
+func cleanupResumeFile() {
+	if config.resumeFile != "" || keepingFiles() || hasKeepOverrides() || keepFilesOnExit {
+		return
+	}
+	removeResumeFile(getResumeFile())
+}
+
+func resumeInfoHash(info lt.TorrentInfo) string {
+	return hex.EncodeToString([]byte(info.InfoHash().ToString()))
+}
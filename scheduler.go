@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+const (
+	schedulerInterval       = 30 * time.Second
+	defaultOverrideDuration = 60 // minutes
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// BandwidthRule limits the rates on the given days between Start and End,
+// in minutes since midnight. End before Start spans midnight. Rates are in
+// kB/s, -1 means unlimited.
+type BandwidthRule struct {
+	Text         string
+	Days         [7]bool
+	Start        int
+	End          int
+	DownloadRate int
+	UploadRate   int
+}
+
+type rateOverride struct {
+	DownloadRate int
+	UploadRate   int
+	Until        time.Time
+}
+
+type BandwidthInfo struct {
+	Schedule     []string `json:"schedule"`
+	ActiveRule   string   `json:"active_rule"`
+	DownloadRate int      `json:"download_rate"`
+	UploadRate   int      `json:"upload_rate"`
+	OverrideEnds int64    `json:"override_ends"`
+}
+
+var (
+	bandwidthLock     sync.Mutex
+	bandwidthSchedule []BandwidthRule
+	bandwidthOverride *rateOverride
+	activeRule        string
+	appliedDownload   = -2
+	appliedUpload     = -2
+)
+
+// parseSchedule parses -bandwidth-schedule: rules separated by ";", each
+// "<days> <HH:MM>-<HH:MM> [dl <kB/s>] [ul <kB/s>]", e.g.
+// "mon-fri 08:00-18:00 ul 50; daily 00:00-06:00 dl unlimited".
+// Days are "daily", "weekdays", "weekends", or day names and ranges
+// separated by commas ("mon,wed,fri-sun").
+func parseSchedule(schedule string) ([]BandwidthRule, error) {
+	var rules []BandwidthRule
+	for _, text := range strings.Split(schedule, ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		rule, err := parseBandwidthRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", text, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseBandwidthRule(text string) (BandwidthRule, error) {
+	rule := BandwidthRule{Text: text, DownloadRate: config.maxDownloadRate, UploadRate: config.maxUploadRate}
+	fields := strings.Fields(strings.ToLower(text))
+	if len(fields) < 4 || len(fields)%2 != 0 {
+		return rule, fmt.Errorf("expected \"<days> <HH:MM>-<HH:MM> [dl <kB/s>] [ul <kB/s>]\"")
+	}
+	var err error
+	if rule.Days, err = parseDays(fields[0]); err != nil {
+		return rule, err
+	}
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return rule, fmt.Errorf("invalid time range: %s", fields[1])
+	}
+	if rule.Start, err = parseClock(times[0]); err != nil {
+		return rule, err
+	}
+	if rule.End, err = parseClock(times[1]); err != nil {
+		return rule, err
+	}
+	for i := 2; i < len(fields); i += 2 {
+		rate, err := parseRate(fields[i+1])
+		if err != nil {
+			return rule, err
+		}
+		switch fields[i] {
+		case "dl":
+			rule.DownloadRate = rate
+		case "ul":
+			rule.UploadRate = rate
+		default:
+			return rule, fmt.Errorf("unknown limit %q, expected dl or ul", fields[i])
+		}
+	}
+	return rule, nil
+}
+
+func parseDays(days string) ([7]bool, error) {
+	var ret [7]bool
+	switch days {
+	case "daily", "*":
+		days = "sun-sat"
+	case "weekdays":
+		days = "mon-fri"
+	case "weekends":
+		days = "sat,sun"
+	}
+	for _, part := range strings.Split(days, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := weekdayNames[bounds[0]]
+		if !ok {
+			return ret, fmt.Errorf("invalid day: %s", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdayNames[bounds[1]]; !ok {
+				return ret, fmt.Errorf("invalid day: %s", bounds[1])
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			ret[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		if clock == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid time: %s", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseRate(rate string) (int, error) {
+	rate = strings.TrimSuffix(rate, "kb/s")
+	if rate == "unlimited" {
+		return -1, nil
+	}
+	value, err := strconv.Atoi(rate)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate: %s", rate)
+	}
+	return value, nil
+}
+
+// matches tells whether the rule applies at t. For a rule spanning
+// midnight, the early morning part belongs to the previous day.
+func (rule *BandwidthRule) matches(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if rule.Start <= rule.End {
+		return rule.Days[day] && minute >= rule.Start && minute < rule.End
+	}
+	if minute >= rule.Start {
+		return rule.Days[day]
+	}
+	return minute < rule.End && rule.Days[(day+6)%7]
+}
+
+// currentLimits returns the rates in effect at now and what set them.
+func currentLimits(now time.Time) (int, int, string) {
+	if bandwidthOverride != nil {
+		if now.Before(bandwidthOverride.Until) {
+			return bandwidthOverride.DownloadRate, bandwidthOverride.UploadRate,
+				"override until " + bandwidthOverride.Until.Format("15:04")
+		}
+		log.Println("bandwidth override expired")
+		bandwidthOverride = nil
+	}
+	for i := range bandwidthSchedule {
+		if bandwidthSchedule[i].matches(now) {
+			return bandwidthSchedule[i].DownloadRate, bandwidthSchedule[i].UploadRate, bandwidthSchedule[i].Text
+		}
+	}
+	return config.maxDownloadRate, config.maxUploadRate, "default"
+}
+
+// applyBandwidthLimits sets the session rate limits from the active rule
+// if they changed.
+func applyBandwidthLimits() {
+	bandwidthLock.Lock()
+	defer bandwidthLock.Unlock()
+
+	download, upload, rule := currentLimits(time.Now())
+	upload = throttledUpload(upload)
+	if rule != activeRule {
+		log.Printf("bandwidth rule: %s (dl %d kB/s, ul %d kB/s)", rule, download, upload)
+		publishEvent("bandwidth_rule", "%s (dl %d kB/s, ul %d kB/s)", rule, download, upload)
+		activeRule = rule
+	}
+	if download == appliedDownload && upload == appliedUpload {
+		return
+	}
+	appliedDownload, appliedUpload = download, upload
+	updateSettings(func(settings lt.SettingsPack) {
+		settings.SetInt("download_rate_limit", rateLimit(download))
+		settings.SetInt("upload_rate_limit", rateLimit(upload))
+	})
+}
+
+// rateLimit converts kB/s to the bytes/s libtorrent expects, where 0
+// means unlimited.
+func rateLimit(rate int) int {
+	if rate < 0 {
+		return 0
+	}
+	return rate * 1024
+}
+
+func runBandwidthScheduler() {
+	for {
+		applyBandwidthLimits()
+		time.Sleep(schedulerInterval)
+	}
+}
+
+func getActiveRule() string {
+	bandwidthLock.Lock()
+	defer bandwidthLock.Unlock()
+	return activeRule
+}
+
+// bandwidthHandler shows the schedule and the limits in effect. POST with
+// dl and/or ul (kB/s, -1 for unlimited) overrides the schedule for
+// minutes (default 60), DELETE cancels the override.
+func bandwidthHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		query := r.URL.Query()
+		bandwidthLock.Lock()
+		download, upload, _ := currentLimits(time.Now())
+		bandwidthLock.Unlock()
+		var err error
+		if dl := query.Get("dl"); dl != "" {
+			if download, err = parseRate(dl); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if ul := query.Get("ul"); ul != "" {
+			if upload, err = parseRate(ul); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		minutes := defaultOverrideDuration
+		if m := query.Get("minutes"); m != "" {
+			if minutes, err = strconv.Atoi(m); err != nil || minutes <= 0 {
+				http.Error(w, "invalid minutes: "+m, http.StatusBadRequest)
+				return
+			}
+		}
+		bandwidthLock.Lock()
+		bandwidthOverride = &rateOverride{
+			DownloadRate: download,
+			UploadRate:   upload,
+			Until:        time.Now().Add(time.Duration(minutes) * time.Minute),
+		}
+		bandwidthLock.Unlock()
+		applyBandwidthLimits()
+	case "DELETE":
+		bandwidthLock.Lock()
+		bandwidthOverride = nil
+		bandwidthLock.Unlock()
+		applyBandwidthLimits()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	bandwidthLock.Lock()
+	download, upload, rule := currentLimits(time.Now())
+	info := BandwidthInfo{
+		Schedule:     []string{},
+		ActiveRule:   rule,
+		DownloadRate: download,
+		UploadRate:   upload,
+	}
+	for _, scheduled := range bandwidthSchedule {
+		info.Schedule = append(info.Schedule, scheduled.Text)
+	}
+	if bandwidthOverride != nil {
+		info.OverrideEnds = bandwidthOverride.Until.Unix()
+	}
+	bandwidthLock.Unlock()
+
+	output, _ := json.Marshal(info)
+	w.Write(output)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	config.maxDownloadRate = -1
+	config.maxUploadRate = -1
+	tests := []struct {
+		schedule string
+		rules    []BandwidthRule
+		ok       bool
+	}{
+		{"", nil, true},
+		{
+			"mon-fri 08:00-18:00 ul 50; daily 00:00-06:00 dl unlimited",
+			[]BandwidthRule{
+				{Days: [7]bool{false, true, true, true, true, true, false}, Start: 8 * 60, End: 18 * 60, DownloadRate: -1, UploadRate: 50},
+				{Days: [7]bool{true, true, true, true, true, true, true}, Start: 0, End: 6 * 60, DownloadRate: -1, UploadRate: -1},
+			},
+			true,
+		},
+		{
+			"fri-mon 22:30-24:00 dl 100kb/s ul 10",
+			[]BandwidthRule{
+				{Days: [7]bool{true, true, false, false, false, true, true}, Start: 22*60 + 30, End: 24 * 60, DownloadRate: 100, UploadRate: 10},
+			},
+			true,
+		},
+		{
+			"weekends 23:00-01:00 dl 0",
+			[]BandwidthRule{
+				{Days: [7]bool{true, false, false, false, false, false, true}, Start: 23 * 60, End: 60, DownloadRate: 0, UploadRate: -1},
+			},
+			true,
+		},
+		{"mon 08:00-18:00", nil, false},
+		{"someday 08:00-18:00 dl 1", nil, false},
+		{"mon 8h-18h dl 1", nil, false},
+		{"mon 25:00-26:00 dl 1", nil, false},
+		{"mon 08:00-18:00 up 1", nil, false},
+		{"mon 08:00-18:00 dl fast", nil, false},
+	}
+	for _, test := range tests {
+		rules, err := parseSchedule(test.schedule)
+		if (err == nil) != test.ok {
+			t.Errorf("parseSchedule(%q): error %v", test.schedule, err)
+			continue
+		}
+		if len(rules) != len(test.rules) {
+			t.Errorf("parseSchedule(%q): got %d rules, want %d", test.schedule, len(rules), len(test.rules))
+			continue
+		}
+		for i, rule := range rules {
+			want := test.rules[i]
+			if rule.Days != want.Days || rule.Start != want.Start || rule.End != want.End ||
+				rule.DownloadRate != want.DownloadRate || rule.UploadRate != want.UploadRate {
+				t.Errorf("parseSchedule(%q): rule %d = %+v, want %+v", test.schedule, i, rule, want)
+			}
+		}
+	}
+}
+
+func TestBandwidthRuleMatches(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		rule    string
+		t       time.Time
+		matches bool
+	}{
+		{"mon-fri 08:00-18:00 ul 50", at(1, 8, 0), true},
+		{"mon-fri 08:00-18:00 ul 50", at(1, 17, 59), true},
+		{"mon-fri 08:00-18:00 ul 50", at(1, 18, 0), false},
+		{"mon-fri 08:00-18:00 ul 50", at(6, 12, 0), false},
+		// spanning midnight, the early morning belongs to the previous day
+		{"fri 23:00-02:00 dl 1", at(5, 23, 30), true},
+		{"fri 23:00-02:00 dl 1", at(6, 1, 59), true},
+		{"fri 23:00-02:00 dl 1", at(5, 1, 0), false},
+		{"sun 23:00-02:00 dl 1", at(1, 1, 0), true},
+		{"sun 23:00-02:00 dl 1", at(2, 1, 0), false},
+		{"sun 23:00-02:00 dl 1", at(7, 23, 0), true},
+	}
+	for _, test := range tests {
+		rule, err := parseBandwidthRule(test.rule)
+		if err != nil {
+			t.Errorf("parseBandwidthRule(%q): %s", test.rule, err)
+			continue
+		}
+		if matches := rule.matches(test.t); matches != test.matches {
+			t.Errorf("%q at %s: matches = %v, want %v", test.rule, test.t.Format("Mon 15:04"), matches, test.matches)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+var (
+	// activeReaders is the number of /files/ requests being served.
+	activeReaders int32
+	seedingLock   sync.Mutex
+	lastReaderAt  time.Time
+	seedingSince  time.Time
+	seedingGoal   string
+)
+
+// trackReaders counts the requests served by handler, for the
+// -seed-while-streaming and -seed-stop-after policies.
+func trackReaders(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&activeReaders, 1)
+		resumeSeeding()
+		defer func() {
+			atomic.AddInt32(&activeReaders, -1)
+			seedingLock.Lock()
+			lastReaderAt = time.Now()
+			seedingLock.Unlock()
+			touchKeptTorrent()
+		}()
+		handler(w, r)
+	}
+}
+
+func seedingPolicyEnabled() bool {
+	return config.seedRatio > 0 || config.seedTime > 0 || config.seedWhileStreaming || config.seedStopAfter >= 0
+}
+
+// shareRatio is the upload/download ratio, counting what was already on
+// disk as downloaded.
+func shareRatio(status lt.TorrentStatus) float64 {
+	downloaded := status.GetAllTimeDownload()
+	if wanted := status.GetTotalWanted(); wanted > downloaded {
+		downloaded = wanted
+	}
+	if downloaded <= 0 {
+		return 0
+	}
+	return float64(status.GetAllTimeUpload()) / float64(downloaded)
+}
+
+// seedingGoalReason returns why seeding should stop, or "" to go on.
+// -seed-time is a minimum for the other goals, or the goal itself when
+// it's the only one set.
+func seedingGoalReason(status lt.TorrentStatus) string {
+	seedingLock.Lock()
+	defer seedingLock.Unlock()
+
+	if seedingSince.IsZero() {
+		seedingSince = time.Now()
+	}
+	seeding := time.Since(seedingSince)
+	if seeding < time.Duration(config.seedTime)*time.Minute {
+		return ""
+	}
+	if config.seedRatio > 0 {
+		if ratio := shareRatio(status); ratio >= config.seedRatio {
+			return fmt.Sprintf("ratio %.2f reached", ratio)
+		}
+	}
+	readers := atomic.LoadInt32(&activeReaders)
+	if config.seedWhileStreaming && readers == 0 {
+		return "no active stream"
+	}
+	if config.seedStopAfter >= 0 && readers == 0 {
+		idleSince := lastReaderAt
+		if idleSince.Before(seedingSince) {
+			idleSince = seedingSince
+		}
+		if time.Since(idleSince) >= time.Duration(config.seedStopAfter)*time.Minute {
+			return fmt.Sprintf("no reader for %d minute(s)", config.seedStopAfter)
+		}
+	}
+	if config.seedRatio <= 0 && !config.seedWhileStreaming && config.seedStopAfter < 0 {
+		return fmt.Sprintf("seeded for %d minute(s)", config.seedTime)
+	}
+	return ""
+}
+
+func getSeedingGoal() string {
+	seedingLock.Lock()
+	defer seedingLock.Unlock()
+	return seedingGoal
+}
+
+// checkSeedingGoal applies -seed-action once the seeding goal of the
+// finished torrent is reached.
+func checkSeedingGoal(status lt.TorrentStatus) {
+	if getSeedingGoal() != "" {
+		return
+	}
+	reason := seedingGoalReason(status)
+	if reason == "" {
+		return
+	}
+	seedingLock.Lock()
+	seedingGoal = reason
+	seedingLock.Unlock()
+	log.Printf("seeding goal reached (%s), action: %s", reason, config.seedAction)
+	publishEvent("seeding_goal", "%s, action: %s", reason, config.seedAction)
+
+	switch config.seedAction {
+	case "pause":
+		torrentHandle.AutoManaged(false)
+		torrentHandle.Pause()
+	case "remove":
+		removeSeededTorrent(reason)
+	case "exit":
+		forceShutdown <- true
+	}
+}
+
+// resumeSeeding resumes the torrent paused by -seed-action pause for
+// lack of readers once a new one arrives, and starts over with the goal.
+func resumeSeeding() {
+	if config.seedAction != "pause" || (!config.seedWhileStreaming && config.seedStopAfter < 0) {
+		return
+	}
+	seedingLock.Lock()
+	reached := seedingGoal != ""
+	seedingGoal = ""
+	seedingLock.Unlock()
+	if !reached || torrentHandle == nil {
+		return
+	}
+	log.Println("new reader, resuming the torrent")
+	publishEvent("seeding_resumed", "new reader")
+	torrentHandle.AutoManaged(true)
+	torrentHandle.Resume()
+}
+
+// removeSeededTorrent removes the main torrent from the session, keeping
+// its files and resume data. torrent2http goes on serving /status and the
+// -watch-dir torrents.
+func removeSeededTorrent(reason string) {
+	keepFilesOnExit = true
+	stopResumeEvents()
+	saveResumeDataOnExit()
+	log.Println("removing the torrent from the session")
+	session.RemoveTorrent(torrentHandle, 0)
+	torrentHandle = nil
+	torrentError = "removed from the session, seeding goal reached: " + reason
+}
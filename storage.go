@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+var (
+	savePathLock sync.RWMutex
+	// savePath is where the data of the main torrent currently is:
+	// -incomplete-path while downloading, -dl-path (or -move-template)
+	// once moved.
+	savePath string
+	// downloadPath is -dl-path, changed by /move.
+	downloadPath string
+	// movingTo is the destination of a move in progress.
+	movingTo string
+
+	movedFilesLock sync.RWMutex
+	// movedFiles maps the files of the main torrent moved on completion by
+	// a {file} -move-template to their path in the torrent.
+	movedFiles = map[int]string{}
+
+	// storageTask is the last /recheck or /move of the main torrent, for
+	// /status.
+	storageTask      string
+	storageTaskState string
+	storageTaskError string
+)
+
+func getSavePath() string {
+	savePathLock.RLock()
+	defer savePathLock.RUnlock()
+	return savePath
+}
+
+func setSavePath(path string) {
+	savePathLock.Lock()
+	savePath = path
+	movingTo = ""
+	savePathLock.Unlock()
+	if torrentFS != nil {
+		torrentFS.SetDir(path)
+	}
+}
+
+// getDownloadPath returns -dl-path, or the destination of the last /move.
+func getDownloadPath() string {
+	savePathLock.RLock()
+	defer savePathLock.RUnlock()
+	if downloadPath == "" {
+		return config.downloadPath
+	}
+	return downloadPath
+}
+
+func setDownloadPath(path string) {
+	savePathLock.Lock()
+	downloadPath = path
+	savePathLock.Unlock()
+}
+
+// initialSavePath is where new torrents are downloaded to.
+func initialSavePath() string {
+	if config.incompletePath != "" {
+		return config.incompletePath
+	}
+	return getDownloadPath()
+}
+
+func moveOnCompletion() bool {
+	return config.incompletePath != "" || config.moveTemplate != ""
+}
+
+// moveFilesOnCompletion tells whether -move-template has a {file}
+// placeholder, i.e. each file of the main torrent is moved once complete
+// rather than the whole torrent once finished.
+func moveFilesOnCompletion() bool {
+	return strings.Contains(config.moveTemplate, "{file}")
+}
+
+// completedPath expands -move-template for a finished torrent, or for
+// file, its path in the torrent. The placeholders are {name}, {hash} and
+// {file}.
+func completedPath(name string, infoHash string, file string) string {
+	if config.moveTemplate == "" {
+		return getDownloadPath()
+	}
+	dir := strings.NewReplacer(
+		"{name}", sanitizePathComponent(name),
+		"{hash}", infoHash,
+		"{file}", file,
+	).Replace(config.moveTemplate)
+	return filepath.Join(getDownloadPath(), filepath.FromSlash(dir))
+}
+
+// sanitizePathComponent keeps a torrent name from escaping -dl-path.
+func sanitizePathComponent(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// moveCompletedStorage moves a finished torrent out of -incomplete-path,
+// or to its -move-template directory. With a {file} -move-template, the
+// files of the main torrent are moved one by one instead.
+func moveCompletedStorage(handle lt.TorrentHandle) {
+	if !moveOnCompletion() || !handle.IsValid() {
+		return
+	}
+	if moveFilesOnCompletion() {
+		if isMainTorrent(handle) {
+			moveCompletedFiles()
+		}
+		return
+	}
+	status := handle.Status()
+	name := status.GetName()
+	current := status.GetSavePath()
+	infoHash := hex.EncodeToString([]byte(status.GetInfoHash().ToString()))
+	lt.DeleteTorrentStatus(status)
+
+	if isCreatedTorrent(infoHash) {
+		// seeded from where /create found it
+		return
+	}
+	dest := completedPath(name, infoHash, "")
+	if filepath.Clean(current) == filepath.Clean(dest) {
+		return
+	}
+	if isMainTorrent(handle) && !claimMove(dest) {
+		// already moving there, or elsewhere with /move
+		return
+	}
+	log.Printf("moving %s to %s", name, dest)
+	handle.MoveStorage(dest)
+}
+
+// claimMove records dest as the destination of the main torrent, unless
+// it's already being moved.
+func claimMove(dest string) bool {
+	savePathLock.Lock()
+	defer savePathLock.Unlock()
+	if movingTo != "" {
+		return false
+	}
+	movingTo = dest
+	return true
+}
+
+func releaseMove() {
+	savePathLock.Lock()
+	movingTo = ""
+	savePathLock.Unlock()
+}
+
+// moveCompletedFiles moves the complete files of the main torrent, e.g.
+// those already complete on restart.
+func moveCompletedFiles() {
+	progresses := lt.NewStdVectorSizeType()
+	defer lt.DeleteStdVectorSizeType(progresses)
+	torrentHandle.FileProgress(progresses, int(lt.WrappedTorrentHandlePieceGranularity))
+
+	files := torrentInfo.Files()
+	for i := 0; i < torrentInfo.NumFiles(); i++ {
+		if progresses.Get(i) == files.FileSize(i) {
+			moveCompletedFile(torrentHandle, i)
+		}
+	}
+}
+
+// moveCompletedFile moves file index of the main torrent to its {file}
+// -move-template path once complete. libtorrent renames it to that
+// absolute path, so it's still seeded, and /files/ keeps serving it.
+func moveCompletedFile(handle lt.TorrentHandle, index int) {
+	if !moveFilesOnCompletion() || !isMainTorrent(handle) || torrentInfo == nil {
+		return
+	}
+	files := torrentInfo.Files()
+	if filepath.IsAbs(files.FilePath(index)) || renamePending(index) {
+		// already moved, here or by the organizer
+		return
+	}
+	original := torrentFilePath(files, index)
+	dest := completedPath(torrentInfo.Name(), currentInfoHash(), filepath.ToSlash(original))
+	if _, err := os.Stat(dest); err == nil {
+		log.Printf("not moving %s, %s already exists", original, dest)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		log.Printf("unable to move %s: %s", original, err)
+		return
+	}
+	log.Printf("moving %s to %s", original, dest)
+	err := requestRename(index, dest, func(message string) {
+		if message != "" {
+			log.Printf("unable to move %s: %s", original, message)
+			publishEvent("storage_move_failed", "%s: %s", original, message)
+			return
+		}
+		movedFilesLock.Lock()
+		movedFiles[index] = original
+		movedFilesLock.Unlock()
+		publishEvent("storage_moved", "%s moved to %s", original, dest)
+		onResumeEvent(handle, "moved")
+		organizeTorrent()
+	})
+	if err != nil {
+		log.Printf("unable to move %s: %s", original, err)
+	}
+}
+
+// movedFilePath is the path in the torrent of file index if it was moved
+// by moveCompletedFile. On restart, the moved path comes from the resume
+// data and the original one from the .torrent.
+func movedFilePath(files lt.FileStorage, index int) (string, bool) {
+	movedFilesLock.RLock()
+	original, ok := movedFiles[index]
+	movedFilesLock.RUnlock()
+	if ok {
+		return original, true
+	}
+	if torrentInfo != nil && filepath.IsAbs(files.FilePath(index)) {
+		return torrentInfo.OrigFiles().FilePath(index), true
+	}
+	return "", false
+}
+
+// movedDiskPath is where the file served as name is on disk, if it was
+// moved out of the save path by the organizer or a {file}
+// -move-template.
+func movedDiskPath(name string) (string, bool) {
+	if torrentInfo == nil {
+		return "", false
+	}
+	files := torrentInfo.Files()
+	for i := 0; i < torrentInfo.NumFiles(); i++ {
+		if filepath.ToSlash(originalFilePath(files, i)) != name {
+			continue
+		}
+		if entry, ok := getLibraryEntry(i); (ok && entry.Moved) || filepath.IsAbs(files.FilePath(i)) {
+			return fileDiskPath(files, i), true
+		}
+		return "", false
+	}
+	return "", false
+}
+
+// onStorageMoved points /files/ and /ls to the new location of the main
+// torrent.
+func onStorageMoved(handle lt.TorrentHandle) {
+	status := handle.Status()
+	path := status.GetSavePath()
+	name := status.GetName()
+	lt.DeleteTorrentStatus(status)
+
+	log.Printf("%s moved to %s", name, path)
+	publishEvent("storage_moved", "%s moved to %s", name, path)
+	onResumeEvent(handle, "moved")
+	if isMainTorrent(handle) {
+		setSavePath(path)
+		if getStorageTask() == "move" {
+			setDownloadPath(path)
+			finishStorageTask("")
+		}
+		recordKeptTorrent()
+		organizeTorrent()
+	}
+}
+
+func onStorageMoveFailed(handle lt.TorrentHandle, message string) {
+	log.Printf("unable to move storage: %s", message)
+	publishEvent("storage_move_failed", "%s", message)
+	if isMainTorrent(handle) {
+		releaseMove()
+		if getStorageTask() == "move" {
+			finishStorageTask(message)
+		}
+	}
+}
+
+func startStorageTask(task string) bool {
+	savePathLock.Lock()
+	defer savePathLock.Unlock()
+	if storageTaskState == "running" {
+		return false
+	}
+	storageTask = task
+	storageTaskState = "running"
+	storageTaskError = ""
+	return true
+}
+
+// getStorageTask returns the /recheck or /move in progress, if any.
+func getStorageTask() string {
+	savePathLock.RLock()
+	defer savePathLock.RUnlock()
+	if storageTaskState != "running" {
+		return ""
+	}
+	return storageTask
+}
+
+func finishStorageTask(err string) {
+	savePathLock.Lock()
+	task := storageTask
+	if err != "" {
+		storageTaskState = "failed"
+	} else {
+		storageTaskState = "done"
+	}
+	storageTaskError = err
+	savePathLock.Unlock()
+
+	if err != "" {
+		log.Printf("%s failed: %s", task, err)
+		publishEvent(task+"_failed", "%s", err)
+	} else {
+		log.Printf("%s done", task)
+		publishEvent(task+"_done", "%s", getSavePath())
+	}
+}
+
+// getStorageTaskState returns the last /recheck or /move, its state
+// (running, done or failed) and its error.
+func getStorageTaskState() (string, string, string) {
+	savePathLock.RLock()
+	defer savePathLock.RUnlock()
+	return storageTask, storageTaskState, storageTaskError
+}
+
+// onTorrentChecked completes a /recheck.
+func onTorrentChecked(handle lt.TorrentHandle) {
+	if isMainTorrent(handle) && getStorageTask() == "recheck" {
+		finishStorageTask("")
+	}
+}
+
+// onTorrentError fails a /recheck that couldn't read the files.
+func onTorrentError(handle lt.TorrentHandle, message string) {
+	if isMainTorrent(handle) && getStorageTask() == "recheck" {
+		finishStorageTask(message)
+	}
+}
+
+// recheckHandler forces a hash check of the main torrent. Its progress is
+// reported by /status.
+func recheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !startStorageTask("recheck") {
+		http.Error(w, "a recheck or move is already running", http.StatusConflict)
+		return
+	}
+	log.Println("forcing recheck")
+	publishEvent("recheck_started", "%s", getSavePath())
+	torrentHandle.ForceRecheck()
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "checking %s", getSavePath())
+}
+
+// resolveInRoot resolves name, relative to root unless absolute, and
+// checks that it's inside root once symlinks are resolved. The part of
+// name that doesn't exist yet is kept as is.
+func resolveInRoot(root string, name string) (string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(root, name)
+	}
+	existing, rest := filepath.Clean(name), ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	resolved = filepath.Join(resolved, rest)
+	if resolved != root && !strings.HasPrefix(resolved, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not inside %s", name, root)
+	}
+	return resolved, nil
+}
+
+// moveHandler moves the data of the main torrent to path, which becomes
+// the new -dl-path once libtorrent is done. The path must be inside
+// -move-root.
+func moveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	dest := r.URL.Query().Get("path")
+	if dest == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+	dest, err := resolveInRoot(config.moveRoot, dest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filepath.Clean(getSavePath()) == dest {
+		http.Error(w, "already in "+dest, http.StatusBadRequest)
+		return
+	}
+	if !claimMove(dest) {
+		http.Error(w, "the torrent is already being moved", http.StatusConflict)
+		return
+	}
+	if !startStorageTask("move") {
+		releaseMove()
+		http.Error(w, "a recheck or move is already running", http.StatusConflict)
+		return
+	}
+	log.Printf("moving storage to %s", dest)
+	publishEvent("move_started", "%s", dest)
+	torrentHandle.MoveStorage(dest)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "moving to %s", dest)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torrent2http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(filepath.Join(root, "Movies"), 0755)
+	os.Symlink(dir, filepath.Join(root, "escape"))
+
+	tests := []struct {
+		name     string
+		resolved string
+	}{
+		{"Movies", filepath.Join(root, "Movies")},
+		{"Movies/New/Dir", filepath.Join(root, "Movies", "New", "Dir")},
+		{".", root},
+		{filepath.Join(root, "New"), filepath.Join(root, "New")},
+		{"..", ""},
+		{"Movies/../../elsewhere", ""},
+		{filepath.Join(dir, "elsewhere"), ""},
+		{"escape/New", ""},
+	}
+	for _, test := range tests {
+		resolved, err := resolveInRoot(root, test.name)
+		if test.resolved == "" {
+			if err == nil {
+				t.Errorf("resolveInRoot(%q) = %q, want an error", test.name, resolved)
+			}
+		} else if err != nil || resolved != test.resolved {
+			t.Errorf("resolveInRoot(%q) = %q, %v, want %q", test.name, resolved, err, test.resolved)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	throttleCheckInterval = time.Second
+	// throttleRecoveryTime is how long the readers must be fed before the
+	// upload rate is restored, so that it doesn't flap.
+	throttleRecoveryTime = 5 * time.Second
+)
+
+var (
+	// waitingReaders counts readers blocked in waitForPiece, lowBufferReaders
+	// those whose readahead window is below -stream-buffer pieces.
+	waitingReaders   int32
+	lowBufferReaders int32
+	throttleLock     sync.Mutex
+	uploadThrottled  bool
+	throttleReason   string
+)
+
+func streamThrottleEnabled() bool {
+	return config.streamThrottleRate >= 0
+}
+
+// throttledUpload caps the upload rate (kB/s, -1 for unlimited) while
+// streaming is starving.
+func throttledUpload(upload int) int {
+	throttleLock.Lock()
+	defer throttleLock.Unlock()
+	if !uploadThrottled {
+		return upload
+	}
+	rate := config.streamThrottleRate
+	if rate < 1 {
+		// 0 is unlimited for libtorrent
+		rate = 1
+	}
+	if upload < 0 || upload > rate {
+		return rate
+	}
+	return upload
+}
+
+func getThrottleState() (bool, string) {
+	throttleLock.Lock()
+	defer throttleLock.Unlock()
+	return uploadThrottled, throttleReason
+}
+
+func setUploadThrottled(throttled bool, reason string) {
+	throttleLock.Lock()
+	uploadThrottled = throttled
+	throttleReason = reason
+	throttleLock.Unlock()
+
+	if throttled {
+		log.Printf("throttling upload to %d kB/s: %s", config.streamThrottleRate, reason)
+		publishEvent("upload_throttled", "upload cut to %d kB/s: %s", config.streamThrottleRate, reason)
+	} else {
+		log.Println("readahead is healthy, restoring upload rate")
+		publishEvent("upload_restored", "readahead is healthy, upload rate restored")
+	}
+	applyBandwidthLimits()
+}
+
+// runStreamThrottle cuts the upload rate while a /files/ reader waits for
+// a piece or runs low on buffered pieces, and restores it once all the
+// readers have been fed for throttleRecoveryTime.
+func runStreamThrottle() {
+	var healthySince time.Time
+	for range time.Tick(throttleCheckInterval) {
+		reason := ""
+		if n := atomic.LoadInt32(&waitingReaders); n > 0 {
+			reason = "reader waiting for a piece"
+		} else if n := atomic.LoadInt32(&lowBufferReaders); n > 0 {
+			reason = "readahead buffer is low"
+		}
+		throttled, _ := getThrottleState()
+		switch {
+		case reason != "":
+			healthySince = time.Time{}
+			if !throttled {
+				setUploadThrottled(true, reason)
+			}
+		case throttled:
+			if healthySince.IsZero() {
+				healthySince = time.Now()
+			} else if time.Since(healthySince) >= throttleRecoveryTime {
+				setUploadThrottled(false, "")
+			}
+		}
+	}
+}
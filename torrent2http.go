@@ -4,20 +4,19 @@ import (
     "encoding/json"
     "encoding/hex"
     "fmt"
-    "io/ioutil"
     "log"
     "math"
-    "math/rand"
+    "net"
     "net/http"
     "net/url"
     "os"
     "os/signal"
-    "path"
     "path/filepath"
     "runtime"
     "strconv"
     "strings"
     "sync"
+    "sync/atomic"
     "syscall"
     "time"
 
@@ -81,6 +80,8 @@ type FilesStatusInfo struct {
     Download int64   `json:"download"`
     Progress float32 `json:"progress"`
     Offset   int64   `json:"offset"`
+    Keep     bool    `json:"keep"`
+    LibraryPath string `json:"library_path"`
 }
 
 type FileStatusInfo struct {
@@ -111,14 +112,22 @@ type FileInfo struct {
 }
 
 type PeerInfo struct {
-    Ip             string  `json:"ip"`
-    Flags          uint    `json:"flags"`
-    Source         uint    `json:"source"`
+    Ip             string   `json:"ip"`
+    Flags          uint     `json:"flags"`
+    FlagNames      []string `json:"flag_names"`
+    Source         uint     `json:"source"`
+    SourceNames    []string `json:"source_names"`
+    ConnectionType string   `json:"connection_type"`
+    Encryption     string   `json:"encryption"`
+    Progress       float32  `json:"progress"`
+    Rtt            int      `json:"rtt"`
     UpSpeed        float32 `json:"up_speed"`
     DownSpeed      float32 `json:"down_speed"`
     TotalUpload    int64   `json:"total_upload"`
     TotalDownload  int64   `json:"total_download"`
     Country        string  `json:"country"`
+    Asn            uint    `json:"asn"`
+    AsOrg          string  `json:"as_org"`
     Client         string  `json:"client"`
 }
 
@@ -163,6 +172,22 @@ type SessionStatus struct {
     TotalPeers    int     `json:"total_peers"`
     HashString    string  `json:"hash_string"`
     SessionStat   string  `json:"session_status"`
+    BlocklistRules int    `json:"blocklist_rules"`
+    BlockedPeers  int64   `json:"blocked_peers"`
+    Proxy         string  `json:"proxy"`
+    ProxyState    string  `json:"proxy_state"`
+    ProxyError    string  `json:"proxy_error"`
+    Ratio         float32 `json:"ratio"`
+    ActiveReaders int32   `json:"active_readers"`
+    SeedingGoal   string  `json:"seeding_goal"`
+    BandwidthRule string  `json:"bandwidth_rule"`
+    UploadThrottled bool  `json:"upload_throttled"`
+    ThrottleReason string `json:"throttle_reason"`
+    StorageTask   string  `json:"storage_task"`
+    StorageState  string  `json:"storage_state"`
+    StorageProgress float32 `json:"storage_progress"`
+    StorageError  string  `json:"storage_error"`
+    FetchState    string  `json:"fetch_state"`
 }
 
 const (
@@ -175,6 +200,9 @@ const (
 var (
     config                   Config
     packSettings             lt.SettingsPack
+    // settingsLock guards packSettings and its ApplySettings, shared by the
+    // HTTP handlers, the bandwidth scheduler and the DHT routers.
+    settingsLock             sync.Mutex
     session                  lt.SessionHandle
     sessionglobal            lt.Session
     torrentHandle            lt.TorrentHandle
@@ -187,6 +215,8 @@ var (
     bufferPiecesProgress     map[int]float64
     mappedPorts              map[string]int
     candidateFiles           map[int]bool
+    magnetOptions            *MagnetOptions
+    torrentError             string
 )
 
 const (
@@ -251,13 +281,16 @@ var errorStrings = map[int]string{
 }
 
 var forceshutdelete = false
+// keepFilesOnExit keeps every file of the torrent on shutdown, whatever
+// -keep-* says. Set by -seed-action=remove.
+var keepFilesOnExit = false
 func statusHandler(w http.ResponseWriter, _ *http.Request) {
     w.Header().Set("Content-Type", "application/json")
 
     var status SessionStatus
     var statsesion string
     if torrentHandle == nil {
-        status = SessionStatus{State: -1}
+        status = SessionStatus{State: -1, Error: torrentError, FetchState: getFetchState()}
     } else {
         tstatus := torrentHandle.Status()
         defer lt.DeleteTorrentStatus(tstatus)
@@ -290,7 +323,32 @@ func statusHandler(w http.ResponseWriter, _ *http.Request) {
             NumSeeds:      tstatus.GetNumSeeds(),
             TotalSeeds:    seedsTotal,
             HashString:    hex.EncodeToString([]byte(tstatus.GetInfoHash().ToString())),
-            SessionStat:   statsesion}
+            SessionStat:   statsesion,
+            Ratio:         float32(shareRatio(tstatus))}
+        status.StorageTask, status.StorageState, status.StorageError = getStorageTaskState()
+        switch status.StorageState {
+        case "running":
+            if status.StorageTask == "recheck" && status.State == STATE_CHECKING_FILES {
+                status.StorageProgress = status.Progress
+            }
+        case "done":
+            status.StorageProgress = 1
+        }
+    }
+    status.ActiveReaders = atomic.LoadInt32(&activeReaders)
+    if status.Error == "" {
+        status.Error = getDiskError()
+    }
+    status.SeedingGoal = getSeedingGoal()
+    status.BandwidthRule = getActiveRule()
+    status.UploadThrottled, status.ThrottleReason = getThrottleState()
+
+    blocklist := getBlocklistInfo()
+    status.BlocklistRules = blocklist.Rules
+    status.BlockedPeers = blocklist.BlockedPeers
+    if proxyConfig != nil {
+        status.Proxy = proxyConfig.String()
+        status.ProxyState, status.ProxyError = getProxyState()
     }
 
     output, _ := json.Marshal(status)
@@ -367,8 +425,9 @@ func lsHandler(w http.ResponseWriter, _ *http.Request) {
                     progress = float32(0)
                 }
                 offset := files.FileOffset(i)
-                pathname := files.FilePath(i)
-                path, _ := filepath.Abs(path.Join(config.downloadPath, pathname))
+                pathname := originalFilePath(files, i)
+                path := fileDiskPath(files, i)
+                libraryEntry, _ := getLibraryEntry(i)
 
                 url := url.URL{
                     Host:   config.bindAddress,
@@ -384,6 +443,8 @@ func lsHandler(w http.ResponseWriter, _ *http.Request) {
                     SavePath: path,
                     URL:      url.String(),
                     Priority: prio,
+                    Keep:     keepFile(i, download == size),
+                    LibraryPath: libraryEntry.Path,
                 }
                 retFiles.Files = append(retFiles.Files, fsi)
             }
@@ -426,8 +487,8 @@ func fileHandler(w http.ResponseWriter, _ *http.Request) {
             download := progresses.Get(fileEntryIdx)
             size := files.FileSize(fileEntryIdx)
             progress := float32(download)/float32(size)
-            name := files.FilePath(fileEntryIdx)
-            path, _ := filepath.Abs(path.Join(config.downloadPath, name))
+            name := originalFilePath(files, fileEntryIdx)
+            path := fileDiskPath(files, fileEntryIdx)
             seedsTotal := status.GetNumComplete()
             if seedsTotal <= 0 {
                 seedsTotal = status.GetListSeeds()
@@ -469,71 +530,24 @@ func fileHandler(w http.ResponseWriter, _ *http.Request) {
     w.Write(output)
 }
 
-func peersHandler(w http.ResponseWriter, _ *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-
-    ret := PeersInfo{}
-
-    vectorPeerInfo := lt.NewStdVectorPeerInfo()
-    torrentHandle.GetPeerInfo(vectorPeerInfo)
-    for i := 0; i < int(vectorPeerInfo.Size()); i++ {
-        peer := vectorPeerInfo.Get(i)
-        pi := PeerInfo{
-            Ip:              fmt.Sprint(peer.GetIp()),
-            Flags:           peer.GetFlags(),
-            Source:          peer.GetSource(),
-            UpSpeed:         float32(peer.GetUpSpeed())/1024,
-            DownSpeed:       float32(peer.GetDownSpeed())/1024,
-            TotalDownload:   peer.GetTotalDownload(),
-            TotalUpload:     peer.GetTotalUpload(),
-            //Country:         peer.GetCountry(),
-            Country:         "",
-            Client:          peer.GetClient(),
-        }
-        ret.Peers = append(ret.Peers, pi)
-    }
-
-    output, _ := json.Marshal(ret)
-    w.Write(output)
-}
-
-func trackersHandler(w http.ResponseWriter, _ *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-
-    ret := TrackersInfo{}
-
-    vectorAnnounceEntry := torrentHandle.Trackers()
-    for i := 0; i < int(vectorAnnounceEntry.Size()); i++ {
-        entry := vectorAnnounceEntry.Get(i)
-        pi := TrackerInfo{
-            Url:				entry.GetUrl(),
-            NextAnnounceIn:		entry.NextAnnounceIn(),
-            MinAnnounceIn:		entry.MinAnnounceIn(),
-            ErrorCode:			entry.GetLastError().Value(),
-            ErrorMessage:		entry.GetLastError().Message().(string),
-            Message:			entry.GetMessage(),
-            Tier:				entry.GetTier(),
-            FailLimit:			entry.GetFailLimit(),
-            Fails:				entry.GetFails(),
-            Source:				entry.GetSource(),
-            Verified:			entry.GetVerified(),
-            Updating:			entry.GetUpdating(),
-            StartSent:			entry.GetStartSent(),
-            CompleteSent:		entry.GetCompleteSent(),
-        }
-        ret.Trackers = append(ret.Trackers, pi)
-    }
-
-    output, _ := json.Marshal(ret)
-    w.Write(output)
-}
-
 func prioHandler(w http.ResponseWriter, r *http.Request) {
     
     query := r.URL.Query()
     ret := ""
     index, err := strconv.Atoi(query.Get("index"))
     priority, err := strconv.Atoi(query.Get("priority"))
+    if err == nil && priority > 0 {
+        fits := checkDiskSpace(func(i int) int {
+            if priority == 9999 || i == index {
+                return 1
+            }
+            return torrentHandle.FilePriority(i).(int)
+        })
+        if !fits {
+            http.Error(w, getDiskError(), http.StatusInsufficientStorage)
+            return
+        }
+    }
     if err == nil {
         if (index != fileEntryIdx) || (torrentHandle.FilePriority(index).(int) != priority){
             if priority == 9999 {
@@ -549,7 +563,7 @@ func prioHandler(w http.ResponseWriter, r *http.Request) {
                 fileEntryIdx = index
                 torrentHandle.FilePriority(index, priority)
                 //torrentHandle.FilePriority(lastEntryIdx, 0)
-                ret = "File named: " + files.FilePath(index) + " is set with priority " + strconv.Itoa(priority)
+                ret = "File named: " + torrentFilePath(files, index) + " is set with priority " + strconv.Itoa(priority)
                 if size > int64(10485760){
                     prioritizepieces()
                 } else {
@@ -576,13 +590,27 @@ func prioHandler(w http.ResponseWriter, r *http.Request) {
             }
         }
     }
+    if err == nil {
+        requestResumeSave("priority changed")
+    }
     
     w.WriteHeader(200)
     w.Write([]byte(ret))
 }
 
+// updateSettings changes packSettings with update and applies them to the
+// session.
+func updateSettings(update func(settings lt.SettingsPack)) {
+    settingsLock.Lock()
+    defer settingsLock.Unlock()
+    update(packSettings)
+    session.ApplySettings(packSettings)
+}
+
 func comandHandler(w http.ResponseWriter, r *http.Request) {
-    
+    settingsLock.Lock()
+    defer settingsLock.Unlock()
+
     settings := packSettings
     query := r.URL.Query()
     ret := ""
@@ -632,8 +660,12 @@ func filesToRemove() []string {
             size := files.FileSize(i)
             completed := downloaded == size
 
-            if ((!config.keepComplete || !completed) && (!config.keepIncomplete || completed)) || forceshutdelete {
-                savePath, _ := filepath.Abs(path.Join(config.downloadPath, files.FilePath(i)))
+            if !keepFile(i, completed) || forceshutdelete {
+                if entry, ok := getLibraryEntry(i); ok && entry.Moved {
+                    // never delete from the library
+                    continue
+                }
+                savePath := fileDiskPath(files, i)
                 if _, err := os.Stat(savePath); !os.IsNotExist(err) {
                     filesToRemove = append(filesToRemove, savePath)
                 }
@@ -658,7 +690,7 @@ func removeFiles(files []string) {
         } else {
             // Remove empty folders as well
             path := filepath.Dir(file)
-            savePath, _ := filepath.Abs(config.downloadPath)
+            savePath, _ := filepath.Abs(getSavePath())
             savePath = trimPathSeparator(savePath)
             for path != savePath {
                 os.Remove(path)
@@ -701,10 +733,12 @@ func removeTorrent() {
     var files []string
 
     state := torrentHandle.Status().GetState()
-    if (state != STATE_CHECKING_FILES && state != STATE_QUEUED_FOR_CHECKING && !config.keepFiles) || forceshutdelete {
-        if (!config.keepComplete && !config.keepIncomplete) || forceshutdelete {
+    overrides := hasKeepOverrides()
+    if (state != STATE_CHECKING_FILES && state != STATE_QUEUED_FOR_CHECKING && (!config.keepFiles || overrides) && !keepFilesOnExit) || forceshutdelete {
+        if ((!config.keepComplete && !config.keepIncomplete && !overrides) || forceshutdelete) && !hasMovedLibraryFiles() {
             flag = int(lt.WrappedSessionHandleDeleteFiles)
         } else {
+            // filesToRemove leaves the files moved to -organize-dir alone
             files = filesToRemove()
         }
     }
@@ -721,7 +755,7 @@ func saveResumeData(async bool) bool {
     if forceshutdelete {
         return false
     }
-    if !torrentHandle.Status().GetNeedSaveResume() || config.resumeFile == "" {
+    if !torrentHandle.Status().GetNeedSaveResume() || getResumeFile() == "" {
         return false
     }
     torrentHandle.SaveResumeData(3)
@@ -740,38 +774,39 @@ func saveSessionState() {
         return
     }
     entry := lt.NewEntry()
+    defer lt.DeleteEntry(entry)
     session.SaveState(entry)
     data := lt.Bencode(entry)
     log.Printf("saving session state to: %s", config.stateFile)
-    err := ioutil.WriteFile(config.stateFile, []byte(data), 0644)
-    if err != nil {
+    if err := writeFileAtomic(config.stateFile, []byte(data)); err != nil {
         log.Println(err)
+        return
     }
+    dhtLock.Lock()
+    stateSavedAt = time.Now()
+    dhtLock.Unlock()
 }
 
 func shutdown() {
     log.Println("stopping torrent2http...")
     if session != nil {
+        stopResumeEvents()
         session.Pause()
         waitForAlert("torrent_paused_alert", 10*time.Second)
         if torrentHandle != nil {
-            saveResumeData(false)
-            saveSessionState()
+            saveResumeDataOnExit()
             removeTorrent()
+            if !forceshutdelete {
+                cleanupResumeFile()
+            }
         }
+        saveSessionState()
         log.Println("aborting the session")
         lt.DeleteSession(sessionglobal)
     }
     if forceshutdelete {
         log.Println("deleting resume file")
-        path := config.resumeFile
-        if _, err := os.Stat(path); !os.IsNotExist(err) {
-            err := os.Remove(path)
-            if err != nil {
-                log.Println("error deleting resume file")
-                log.Println(err)
-            }
-        }
+        removeResumeFile(getResumeFile())
     }
     log.Println("bye bye")
     os.Exit(0)
@@ -785,6 +820,22 @@ func connectionCounterHandler(connTrackChannel chan int, handler http.Handler) h
     })
 }
 
+// requireTorrent answers with the error that prevented adding the torrent
+// instead of calling handler while there is no torrent handle.
+func requireTorrent(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if torrentHandle == nil {
+            if fetch := getFetchState(); fetch != "" {
+                http.Error(w, "torrent not added yet: "+fetch, http.StatusServiceUnavailable)
+                return
+            }
+            http.Error(w, "torrent not added: "+torrentError, http.StatusServiceUnavailable)
+            return
+        }
+        handler(w, r)
+    }
+}
+
 func inactiveAutoShutdown(connTrackChannel chan int) {
     activeConnections := 0
     for {
@@ -805,13 +856,26 @@ func startHTTP() {
     log.Println("starting HTTP Server...")
 
     http.HandleFunc("/status", statusHandler)
-    http.HandleFunc("/ls", lsHandler)
-    http.HandleFunc("/lsfile", fileHandler)
-    http.HandleFunc("/peers", peersHandler)
-    http.HandleFunc("/trackers", trackersHandler)
+    http.HandleFunc("/ls", requireTorrent(lsHandler))
+    http.HandleFunc("/lsfile", requireTorrent(fileHandler))
+    http.HandleFunc("/peers", requireTorrent(peersHandler))
+    http.HandleFunc("/peers/summary", requireTorrent(peersSummaryHandler))
+    http.HandleFunc("/peers/ban", banHandler)
+    http.HandleFunc("/blocklist", blocklistHandler)
+    http.HandleFunc("/network", networkHandler)
+    http.HandleFunc("/dht", dhtHandler)
+    http.HandleFunc("/bandwidth", bandwidthHandler)
+    http.HandleFunc("/peers/disconnect", disconnectHandler)
+    http.HandleFunc("/trackers", requireTorrent(trackersHandler))
+    http.HandleFunc("/trackers/reannounce", requireTorrent(reannounceHandler))
     http.HandleFunc("/command", comandHandler)
+    http.HandleFunc("/events", eventsHandler)
     http.Handle("/get/", http.StripPrefix("/get/", getHandler(http.FileServer(torrentFS))))
-    http.HandleFunc("/priority", prioHandler)
+    http.HandleFunc("/priority", requireTorrent(prioHandler))
+    http.HandleFunc("/recheck", requireTorrent(recheckHandler))
+    http.HandleFunc("/move", requireTorrent(moveHandler))
+    http.HandleFunc("/inspect", inspectHandler)
+    http.HandleFunc("/create", createHandler)
     http.HandleFunc("/stopanddelete", func(w http.ResponseWriter, _ *http.Request) {
         fmt.Fprintf(w, "torrent stopped and files deleted")
         forceshutdelete = true
@@ -825,26 +889,38 @@ func startHTTP() {
         fmt.Fprintf(w, "Torrent Stopped")
         session.Pause()
     })
-    http.HandleFunc("/pausetorrent", func(w http.ResponseWriter, _ *http.Request) {
+    http.HandleFunc("/pausetorrent", requireTorrent(func(w http.ResponseWriter, _ *http.Request) {
         fmt.Fprintf(w, "Torrent Paused")
         torrentHandle.AutoManaged(false)
         torrentHandle.Pause(0)
         torrentHandle.Pause()
-    })
-    http.HandleFunc("/resumetorrent", func(w http.ResponseWriter, _ *http.Request) {
+    }))
+    http.HandleFunc("/resumetorrent", requireTorrent(func(w http.ResponseWriter, _ *http.Request) {
         fmt.Fprintf(w, "Torrent Resumed")
         torrentHandle.AutoManaged(true)
         torrentHandle.Resume()
-    })
+    }))
     http.HandleFunc("/resume", func(w http.ResponseWriter, _ *http.Request) {
+        // the kill switch resumes the session once the interfaces are up
+        if isKillSwitchPaused() {
+            http.Error(w, "session paused by the kill switch, a bound interface is down", http.StatusConflict)
+            return
+        }
         fmt.Fprintf(w, "Torrent Started")
         session.Resume()
     })
 // 	http.Handle("/files/", http.StripPrefix("/files/", http.FileServer(torrentFS)))
-    http.Handle("/files/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    serveFile := trackReaders(func(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Connection", "close")
         handler := http.StripPrefix("/files/", http.FileServer(torrentFS))
         handler.ServeHTTP(w, r)
+    })
+    http.Handle("/files/", requireTorrent(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "POST" || r.Method == "DELETE" {
+            fileActionHandler(w, r)
+            return
+        }
+        serveFile(w, r)
     }))
 
     handler := http.Handler(http.DefaultServeMux)
@@ -875,6 +951,12 @@ func logAlert(alert lt.Alert) {
     case "url_seed_alert":
         str = lt.SwigcptrUrlSeedAlert(alert.Swigcptr()).ErrorMessage()
         break
+    case "peer_blocked_alert", "dht_announce_alert", "dht_get_peers_alert", "dht_reply_alert", "dht_stats_alert":
+        // there can be a lot of them with a big blocklist or a busy DHT
+        if !config.debugAlerts {
+            return
+        }
+        break
     }
     if str != "" {
         log.Printf("(%s) %s: %s", alert.What(), alert.Message(), str)
@@ -885,9 +967,13 @@ func logAlert(alert lt.Alert) {
 
 func processSaveResumeDataAlert(alert lt.Alert) {
     saveResumeDataAlert := lt.SwigcptrSaveResumeDataAlert(alert.Swigcptr())
-    log.Printf("saving resume data to: %s", config.resumeFile)
+    path := getResumeFile()
+    if path == "" || !isMainTorrent(saveResumeDataAlert.GetHandle()) {
+        return
+    }
+    log.Printf("saving resume data to: %s", path)
     data := lt.Bencode(saveResumeDataAlert.ResumeData())
-    err := ioutil.WriteFile(config.resumeFile, []byte(data), 0644)
+    err := writeResumeData(path, []byte(data))
     if err != nil {
         log.Println(err)
     }
@@ -898,12 +984,76 @@ func processAlert(alert lt.Alert) {
     case "save_resume_data_alert":
         processSaveResumeDataAlert(alert)
         break
+    case "peer_blocked_alert":
+        atomic.AddInt64(&blockedPeers, 1)
+        break
+    case "portmap_alert", "portmap_error_alert":
+        addPortMappingEvent(alert.Message())
+        break
+    case "dht_stats_alert":
+        onDHTStats(alert)
+        break
+    case "dht_bootstrap_alert":
+        onDHTBootstrap()
+        break
+    case "torrent_finished_alert":
+        handle := lt.SwigcptrTorrentAlert(alert.Swigcptr()).GetHandle()
+        onResumeEvent(handle, "finished")
+        moveCompletedStorage(handle)
+        if isMainTorrent(handle) && (!moveOnCompletion() || moveFilesOnCompletion()) {
+            organizeTorrent()
+        }
+        break
+    case "file_completed_alert":
+        completedAlert := lt.SwigcptrFileCompletedAlert(alert.Swigcptr())
+        moveCompletedFile(completedAlert.GetHandle(), completedAlert.GetIndex())
+        break
+    case "storage_moved_alert":
+        onStorageMoved(lt.SwigcptrTorrentAlert(alert.Swigcptr()).GetHandle())
+        break
+    case "storage_moved_failed_alert":
+        onStorageMoveFailed(lt.SwigcptrTorrentAlert(alert.Swigcptr()).GetHandle(), alert.Message())
+        break
+    case "file_renamed_alert":
+        renamedAlert := lt.SwigcptrFileRenamedAlert(alert.Swigcptr())
+        onFileRenamed(renamedAlert.GetHandle(), renamedAlert.GetIndex(), renamedAlert.NewName())
+        break
+    case "file_rename_failed_alert":
+        failedAlert := lt.SwigcptrFileRenameFailedAlert(alert.Swigcptr())
+        onFileRenameFailed(failedAlert.GetHandle(), failedAlert.GetIndex(), alert.Message())
+        break
+    case "torrent_checked_alert":
+        onTorrentChecked(lt.SwigcptrTorrentAlert(alert.Swigcptr()).GetHandle())
+        onResumeEvent(lt.SwigcptrTorrentAlert(alert.Swigcptr()).GetHandle(), "checked")
+        break
+    case "torrent_paused_alert":
+        onResumeEvent(lt.SwigcptrTorrentAlert(alert.Swigcptr()).GetHandle(), "paused")
+        break
+    case "torrent_error_alert", "file_error_alert":
+        onTorrentError(lt.SwigcptrTorrentAlert(alert.Swigcptr()).GetHandle(), alert.Message())
+        break
+    case "i2p_alert":
+        setI2PError(alert.Message())
+        break
     case "metadata_received_alert":
-        onMetadataReceived()
+        handle := lt.SwigcptrMetadataReceivedAlert(alert.Swigcptr()).GetHandle()
+        onCuratedMetadata(handle)
+        if isMainTorrent(handle) {
+            onMetadataReceived()
+        }
         break
     }
 }
 
+// isMainTorrent tells whether handle refers to the torrent given by -uri,
+// as opposed to one added from -watch-dir.
+func isMainTorrent(handle lt.TorrentHandle) bool {
+    if torrentHandle == nil || !handle.IsValid() {
+        return false
+    }
+    return handle.InfoHash().ToString() == torrentHandle.InfoHash().ToString()
+}
+
 func consumeAlerts() {
     var alerts lt.StdVectorAlerts
     alerts = session.PopAlerts()
@@ -916,45 +1066,74 @@ func consumeAlerts() {
     }
 }
 
-func buildTorrentParams(uri string) lt.AddTorrentParams {
+func buildTorrentParams(uri string, resumeFile string) (lt.AddTorrentParams, error) {
+    uri = magnetFromInfoHash(uri)
     fileUri, err := url.Parse(uri)
-    torrentParams := lt.NewAddTorrentParams()
-    error := lt.NewErrorCode()
     if err != nil {
-        log.Fatal(err)
+        return nil, err
     }
+    torrentParams := lt.NewAddTorrentParams()
+    fail := func(err error) (lt.AddTorrentParams, error) {
+        lt.DeleteAddTorrentParams(torrentParams)
+        return nil, err
+    }
+    errorCode := lt.NewErrorCode()
+    defer lt.DeleteErrorCode(errorCode)
+    infoHash := infoHashFromMagnet(uri)
     if fileUri.Scheme == "file" {
-        uriPath := fileUri.Path
-        if uriPath != "" && runtime.GOOS == "windows" && os.IsPathSeparator(uriPath[0]) {
-            uriPath = uriPath[1:]
-        }
-        absPath, err := filepath.Abs(uriPath)
+        absPath, err := filepath.Abs(fileURIPath(fileUri))
         if err != nil {
-            log.Fatalf(err.Error())
+            return fail(err)
         }
         log.Printf("opening local file: %s", absPath)
         if _, err := os.Stat(absPath); err != nil {
-            log.Fatalf(err.Error())
+            return fail(err)
+        }
+        if err := validateTorrentFile(absPath); err != nil {
+            return fail(fmt.Errorf("invalid torrent file %s: %s", absPath, err))
         }
-        torrentInfo := lt.NewTorrentInfo(absPath, error)
-        if error.Value() != 0 {
-            log.Fatalln(error.Message())
+        torrentInfo := lt.NewTorrentInfo(absPath, errorCode)
+        if errorCode.Value() != 0 {
+            lt.DeleteTorrentInfo(torrentInfo)
+            return fail(fmt.Errorf("%s: %s", absPath, errorCode.Message()))
         }
+        infoHash = resumeInfoHash(torrentInfo)
         torrentParams.SetTorrentInfo(torrentInfo)
+    } else if fileUri.Scheme == "http" || fileUri.Scheme == "https" {
+        torrentPath, err := fetchTorrent(uri)
+        if err != nil {
+            return fail(err)
+        }
+        defer os.Remove(torrentPath)
+        if err := validateTorrentFile(torrentPath); err != nil {
+            return fail(fmt.Errorf("invalid torrent file from %s: %s", uri, err))
+        }
+        torrentInfo := lt.NewTorrentInfo(torrentPath, errorCode)
+        if errorCode.Value() != 0 {
+            lt.DeleteTorrentInfo(torrentInfo)
+            return fail(fmt.Errorf("invalid torrent file from %s: %s", uri, errorCode.Message()))
+        }
+        infoHash = resumeInfoHash(torrentInfo)
+        torrentParams.SetTorrentInfo(torrentInfo)
+    } else if cachedInfo := loadCachedMetadata(infoHashFromMagnet(uri)); cachedInfo != nil {
+        torrentParams.SetTorrentInfo(cachedInfo)
     } else {
         log.Printf("will fetch: %s", uri)
         torrentParams.SetUrl(uri)
     }
 
-    log.Printf("setting save path: %s", config.downloadPath)
-    torrentParams.SetSavePath(config.downloadPath)
+    log.Printf("setting save path: %s", initialSavePath())
+    torrentParams.SetSavePath(initialSavePath())
 
-    if _, err := os.Stat(config.resumeFile); !os.IsNotExist(err) {
-        log.Printf("loading resume file: %s", config.resumeFile)
-        bytes, err := ioutil.ReadFile(config.resumeFile)
+    if resumeFile == "" {
+        resumeFile = defaultResumeFile(infoHash)
+    }
+    if resumeFile != "" {
+        bytes, err := readResumeData(resumeFile)
         if err != nil {
             log.Println(err)
-        } else {
+        } else if bytes != nil {
+            log.Printf("loading resume file: %s", resumeFile)
             resumeData := lt.NewStdVectorChar()
             defer lt.DeleteStdVectorChar(resumeData)
             for _, byte := range bytes {
@@ -969,17 +1148,14 @@ func buildTorrentParams(uri string) lt.AddTorrentParams {
         torrentParams.SetStorageMode(lt.StorageModeAllocate)
     }
 
-    return torrentParams
+    return torrentParams, nil
 }
 
 func startServices() {
+    settingsLock.Lock()
     if config.enableDHT {
-        bootstrapNodes := ""
-        if config.dhtRouters != "" {
-            bootstrapNodes = config.dhtRouters + "," + strings.Join(dhtBootstrapNodes, ",")
-        } else {
-            bootstrapNodes = strings.Join(dhtBootstrapNodes, ",")
-        }
+        initDHTRouters()
+        bootstrapNodes := strings.Join(getDHTRouters(), ",")
         if bootstrapNodes != "" {
             log.Println("starting DHT...")
             packSettings.SetStr("dht_bootstrap_nodes", bootstrapNodes)
@@ -1000,6 +1176,7 @@ func startServices() {
     }
 
     session.ApplySettings(packSettings)
+    settingsLock.Unlock()
     for p := range mappedPorts {
         port, _ := strconv.Atoi(p)
         mappedPorts[p] = session.AddPortMapping(lt.WrappedSessionHandleTcp, port, port)
@@ -1137,45 +1314,36 @@ func startSession() {
     settings.SetInt("allowed_enc_level", level)
     settings.SetBool("prefer_rc4", preferRc4)
 
-    settings.SetInt("proxy_type", ProxyTypeNone)
+    setProxySettings(settings)
 
     // Set alert_mask here so it also applies on reconfigure...
-    settings.SetInt("alert_mask", int(lt.AlertErrorNotification) | int(lt.AlertStorageNotification) |
-        int(lt.AlertTrackerNotification) | int(lt.AlertStatusNotification))
+    alertMask := int(lt.AlertErrorNotification) | int(lt.AlertStorageNotification) |
+        int(lt.AlertTrackerNotification) | int(lt.AlertStatusNotification) | int(lt.AlertIpBlockNotification) |
+        int(lt.AlertPortMappingNotification) | int(lt.AlertDhtNotification)
+    if moveFilesOnCompletion() {
+        // for file_completed_alert
+        alertMask |= int(lt.AlertProgressNotification)
+    }
+    settings.SetInt("alert_mask", alertMask)
     
     if config.debugAlerts {
         settings.SetInt("alert_mask", int(lt.AlertAllCategories))
         settings.SetInt("alert_queue_size", 2500)
     }
     
-    var listenPorts []string
-    rand.Seed(time.Now().UTC().UnixNano())
-    portLower := config.listenPort
-    if config.randomPort {
-        portLower = rand.Intn(16374)+49152
-    }
-    portUpper := portLower + 5
-
-    for p := portLower; p <= portUpper; p++ {
-        listenPorts = append(listenPorts, strconv.Itoa(p))
-    }
-
-    listenInterfaces := []string{"0.0.0.0"}
-    rand.Seed(time.Now().UTC().UnixNano())
-    mappedPorts = map[string]int{}
+    chosenPort = chooseListenPort()
+    port := strconv.Itoa(chosenPort)
+    mappedPorts = map[string]int{port: -1}
     listenInterfacesStrings := make([]string, 0)
-    for _, listenInterface := range listenInterfaces {
-        port := listenPorts[rand.Intn(len(listenPorts))]
-        mappedPorts[port] = -1
+    for _, listenInterface := range listenHosts() {
         listenInterfacesStrings = append(listenInterfacesStrings, listenInterface+":"+port)
-        if len(listenPorts) > 1 {
-            port := listenPorts[rand.Intn(len(listenPorts))]
-            mappedPorts[port] = -1
-            listenInterfacesStrings = append(listenInterfacesStrings, listenInterface+":"+port)
-        }
     }
     settings.SetStr("listen_interfaces", strings.Join(listenInterfacesStrings, ","))
     log.Printf("Listening on: %s", strings.Join(listenInterfacesStrings, ","))
+    if config.outgoingInterface != "" {
+        settings.SetStr("outgoing_interfaces", config.outgoingInterface)
+        log.Printf("Outgoing interfaces: %s", config.outgoingInterface)
+    }
 // 	var listenPorts []string
 // 	portLower := config.listenPort
 // 	rand.Seed(time.Now().UTC().UnixNano())
@@ -1220,6 +1388,11 @@ func startSession() {
         log.Printf("Could not create libtorrent session handle: %s", err)
         return
     }
+    if config.killSwitch {
+        // resumed by interfaceKillSwitch once the bound interfaces are up
+        setKillSwitchPaused(true)
+        session.Pause()
+    }
 }
 
 func chooseFile() int {
@@ -1280,45 +1453,107 @@ func getFilePiecesAndOffset(ind int) (int, int, int64) {
 func addTorrent(torrentParams lt.AddTorrentParams) {
     log.Println("adding torrent")
     var err error
-    torrentHandle, err = session.AddTorrent(torrentParams)
+    torrentHandle, err = addTorrentToSession(torrentParams, magnetOptions)
     if err != nil {
         log.Printf("Error adding torrent: %s", err)
+        torrentHandle = nil
+        torrentError = err.Error()
+        return
     }
 
+    initResumeFile()
+
     log.Println("enabling sequential download")
     torrentHandle.SetSequentialDownload(true)
 
-    //trackers := defaultTrackers
+    status := torrentHandle.Status()
+    log.Printf("downloading torrent: %s", status.GetName())
+    // resume data may point to where the torrent was moved last time
+    setSavePath(status.GetSavePath())
+    state := status.GetState()
+    lt.DeleteTorrentStatus(status)
+    torrentFS = NewTorrentFS(torrentHandle, getSavePath())
+    if state == STATE_FINISHED || state == STATE_SEEDING {
+        moveCompletedStorage(torrentHandle)
+    }
+
+    if torrentHandle.Status().GetHasMetadata() {
+        onMetadataReceived()
+    }
+}
+
+// addTorrentToSession adds a torrent along with the -trackers and the
+// extra magnet link options. It is shared by the main torrent and the
+// ones picked up from -watch-dir.
+func addTorrentToSession(torrentParams lt.AddTorrentParams, magnet *MagnetOptions) (lt.TorrentHandle, error) {
+    handle, err := session.AddTorrent(torrentParams)
+    if err != nil {
+        return nil, err
+    }
+
     var trackers []string
+    if magnet != nil {
+        trackers = magnet.Trackers
+    }
     if config.trackers != "" {
-        trackers = strings.Split(config.trackers, ",")
+        trackers = mergeTrackers(trackers, strings.Split(config.trackers, ","))
     }
-    startTier := 256 - len(trackers)
-    for n, tracker := range trackers {
-        tracker = strings.TrimSpace(tracker)
-        announceEntry := lt.NewAnnounceEntry(tracker)
-        announceEntry.SetTier(byte(startTier + n))
-        log.Printf("adding tracker: %s", tracker)
-        torrentHandle.AddTracker(announceEntry)
+    addTrackers(handle, trackers, -1)
+    addCuratedTrackers(handle, getCuratedTrackers())
+
+    if magnet != nil {
+        for _, webSeed := range magnet.WebSeeds {
+            log.Printf("adding web seed: %s", webSeed)
+            handle.AddUrlSeed(webSeed)
+        }
+        for _, peer := range magnet.Peers {
+            log.Printf("connecting to peer: %s", peer)
+            if err := connectPeer(handle, peer); err != nil {
+                log.Println(err)
+            }
+        }
     }
 
     if config.enableScrape {
         log.Println("sending scrape request to tracker")
-        torrentHandle.ScrapeTracker()
+        handle.ScrapeTracker()
     }
+    return handle, nil
+}
 
-    log.Printf("downloading torrent: %s", torrentHandle.Status().GetName())
-    torrentFS = NewTorrentFS(torrentHandle, config.downloadPath)
-
-    if torrentHandle.Status().GetHasMetadata() {
-        onMetadataReceived()
+// connectPeer makes libtorrent connect to the given host:port immediately.
+func connectPeer(handle lt.TorrentHandle, address string) error {
+    host, portStr, err := net.SplitHostPort(address)
+    if err != nil {
+        return err
     }
+    port, err := strconv.Atoi(portStr)
+    if err != nil {
+        return fmt.Errorf("invalid peer port: %s", address)
+    }
+    ip := net.ParseIP(host)
+    if ip == nil {
+        ips, err := net.LookupIP(host)
+        if err != nil || len(ips) == 0 {
+            return fmt.Errorf("unable to resolve peer: %s", address)
+        }
+        ip = ips[0]
+    }
+    addr := lt.AddressFromString(ip.String())
+    defer lt.DeleteAddress(addr)
+    endpoint := lt.NewTcpEndpoint(addr, port)
+    defer lt.DeleteTcpEndpoint(endpoint)
+    handle.ConnectPeer(endpoint)
+    return nil
 }
 
 func onMetadataReceived() {
     log.Printf("metadata received")
 
     torrentInfo = torrentHandle.TorrentFile()
+    saveMetadataToCache()
+    loadLibraryEntries()
+    sanitizeFileNames()
     
     fileEntryIdx = chooseFile()
 
@@ -1326,7 +1561,31 @@ func onMetadataReceived() {
     filepriorities := torrentHandle.FilePriorities()
     defer lt.DeleteStdVectorInt(filepriorities)
     
-    if config.fileIndex == 9999 || config.fileIndex == -1 {
+    selected := magnetOptions.selectedFiles(numFiles)
+    prioritize := config.fileIndex != 9999 && config.fileIndex != -1
+    if len(selected) > 0 {
+        // so= from the magnet link takes precedence over -file-index
+        log.Printf("selecting %d file(s) from magnet link", len(selected))
+        files := torrentInfo.Files()
+        maxSize := int64(-1)
+        for i := range selected {
+            if size := files.FileSize(i); size > maxSize {
+                maxSize = size
+                fileEntryIdx = i
+            }
+        }
+        for i := 0; i < numFiles; i++ {
+            if selected[i] {
+                filepriorities.Set(i, 4)
+            } else {
+                filepriorities.Set(i, 0)
+            }
+        }
+        prioritize = len(selected) == 1
+        if prioritize {
+            filepriorities.Set(fileEntryIdx, 7)
+        }
+    } else if !prioritize {
         for i := 0; i < numFiles; i++ {
             if config.fileIndex == 9999 {
                 filepriorities.Set(i, 4)
@@ -1343,8 +1602,12 @@ func onMetadataReceived() {
             }
         }
     }
+    recordKeptTorrent()
+    if !checkDiskSpace(func(i int) int { return filepriorities.Get(i) }) {
+        pauseForDiskSpace()
+    }
     torrentHandle.PrioritizeFiles(filepriorities)
-    if config.fileIndex == 9999 || config.fileIndex == -1 {
+    if !prioritize {
         log.Printf("Not prioritizing pieces this time")
     } else {
         prioritizepieces()
@@ -1445,9 +1708,8 @@ func IsMemoryStorage() bool {
 }
 
 func handleSignals() {
-    forceShutdown = make(chan bool, 1)
     signalChan := make(chan os.Signal, 1)
-    saveResumeDataTicker := time.Tick(30 * time.Second)
+    saveResumeDataTicker := time.Tick(resumeSaveInterval)
     signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 
     for {
@@ -1459,17 +1721,24 @@ func handleSignals() {
             forceShutdown <- true
         case <-time.After(500 * time.Millisecond):
             consumeAlerts()
-            status := torrentHandle.Status()
-            defer lt.DeleteTorrentStatus(status)
-            state := status.GetState()
-            if config.exitOnFinish && (state == STATE_FINISHED || state == STATE_SEEDING) {
-                forceShutdown <- true
+            if torrentHandle != nil {
+                status := torrentHandle.Status()
+                state := status.GetState()
+                if config.exitOnFinish && (state == STATE_FINISHED || state == STATE_SEEDING) {
+                    forceShutdown <- true
+                } else if seedingPolicyEnabled() && (state == STATE_FINISHED || state == STATE_SEEDING) {
+                    checkSeedingGoal(status)
+                }
+                checkResumePieces(status)
+                lt.DeleteTorrentStatus(status)
             }
             if os.Getppid() == 1 {
                 forceShutdown <- true
             }
         case <-saveResumeDataTicker:
-            saveResumeData(true)
+            if torrentHandle != nil {
+                saveResumeData(true)
+            }
         }
     }
 }
@@ -1478,12 +1747,65 @@ func main() {
     // Make sure we are properly multi-threaded, on a minimum of 2 threads
     // because we lock the main thread for lt.
     runtime.GOMAXPROCS(runtime.NumCPU())
+    if len(os.Args) > 1 {
+        switch os.Args[1] {
+        case "inspect":
+            os.Exit(inspectCommand(os.Args[2:]))
+        case "info":
+            os.Exit(infoCommand(os.Args[2:]))
+        case "verify":
+            os.Exit(verifyCommand(os.Args[2:]))
+        case "create":
+            os.Exit(createCommand(os.Args[2:]))
+        }
+    }
     config.parseFlags()
 
     startSession()
+    if config.enableDHT && config.stateFile != "" {
+        loadDHTState()
+    }
     startServices()
-    addTorrent(buildTorrentParams(config.uri))
+    if config.stateFile != "" {
+        go saveSessionStatePeriodically()
+    }
+    go runBandwidthScheduler()
+    if config.maxDiskUsage > 0 {
+        go enforceDiskQuota()
+    }
+    if streamThrottleEnabled() {
+        go runStreamThrottle()
+    }
+    if config.blocklist != "" {
+        go refreshBlocklist()
+    }
+    if config.geoIPDB != "" {
+        openGeoIP()
+    }
+    if proxyConfig != nil {
+        go monitorProxy()
+    }
+    if config.killSwitch {
+        go interfaceKillSwitch()
+    }
+    // up while the .torrent is fetched, for /status to report it
+    forceShutdown = make(chan bool, 1)
+    go startHTTP()
+
+    magnetOptions = parseMagnet(magnetFromInfoHash(config.uri))
+    if torrentParams, err := buildTorrentParams(config.uri, config.resumeFile); err != nil {
+        log.Printf("unable to add torrent: %s", err)
+        torrentError = err.Error()
+    } else {
+        addTorrent(torrentParams)
+    }
+
+    if config.watchDir != "" {
+        go watchFolder()
+    }
+    if config.defaultTrackers || config.trackersFile != "" || config.trackersURL != "" {
+        go refreshCuratedTrackers()
+    }
 
-    go handleSignals()
-    startHTTP()
+    handleSignals()
 }
@@ -11,6 +11,7 @@ import (
     "path/filepath"
     "strings"
     "sync"
+    "sync/atomic"
     "time"
     "unsafe"
 
@@ -24,6 +25,10 @@ const (
 type TorrentFS struct {
 	handle   lt.TorrentHandle
 	Dir      http.Dir
+	dirMx    sync.RWMutex
+	openMx   sync.Mutex
+	// openFiles counts the open readers of each file index
+	openFiles map[int]int
 }
 
 type TorrentFile struct {
@@ -40,6 +45,7 @@ type TorrentFile struct {
 	lastStatus        lt.TorrentStatus
 	closed            bool
 	path              string
+	bufferLow         bool
 	
 }
 
@@ -50,12 +56,40 @@ type PieceRange struct {
 
 func NewTorrentFS(handle lt.TorrentHandle, path string) *TorrentFS {
     tfs := TorrentFS{
-        handle:   handle,
-        Dir:      http.Dir(path),
+        handle:    handle,
+        Dir:       http.Dir(path),
+        openFiles: make(map[int]int),
     }
     return &tfs
 }
 
+// SetDir points the file system to the new location of the torrent data,
+// e.g. after move_storage. Files already open keep reading the old ones.
+func (tfs *TorrentFS) SetDir(path string) {
+    tfs.dirMx.Lock()
+    defer tfs.dirMx.Unlock()
+    tfs.Dir = http.Dir(path)
+}
+
+func (tfs *TorrentFS) getDir() string {
+    tfs.dirMx.RLock()
+    defer tfs.dirMx.RUnlock()
+    return string(tfs.Dir)
+}
+
+// IsOpen tells whether a reader has the file at index open.
+func (tfs *TorrentFS) IsOpen(index int) bool {
+    tfs.openMx.Lock()
+    defer tfs.openMx.Unlock()
+    return tfs.openFiles[index] > 0
+}
+
+func (tfs *TorrentFS) trackOpen(index int, delta int) {
+    tfs.openMx.Lock()
+    defer tfs.openMx.Unlock()
+    tfs.openFiles[index] += delta
+}
+
 func (tfs *TorrentFS) Open(uname string) (http.File, error) {
     name := DecodeFileURL(uname)
     
@@ -65,7 +99,11 @@ func (tfs *TorrentFS) Open(uname string) (http.File, error) {
     if name == "/" {
         return nil, errors.New("file no found")
     }
-    file, err = os.Open(filepath.Join(string(tfs.Dir), name))
+    diskPath := filepath.Join(tfs.getDir(), name)
+    if movedPath, ok := movedDiskPath(name[1:]); ok {
+        diskPath = movedPath
+    }
+    file, err = os.Open(diskPath)
     if err != nil {
         log.Printf("File not yet downloaded: %s", err)
         return nil, err
@@ -84,7 +122,7 @@ func (tfs *TorrentFS) Open(uname string) (http.File, error) {
     numFiles := torrentInfo.NumFiles()
     files := torrentInfo.Files()
     for j := 0; j < numFiles; j++ {
-        path := files.FilePath(j)
+        path := originalFilePath(files, j)
         if name[1:] == path {
             return NewTorrentFile(file, tfs, torrentInfo, j, files.FileOffset(j), files.FileSize(j), path)
         }
@@ -106,6 +144,7 @@ func NewTorrentFile(file http.File, tfs *TorrentFS, torrentInfo lt.TorrentInfo,
         fileSize:     size,
         path:         path,
     }
+    tfs.trackOpen(fileEntryIdx, 1)
     tf.log("opening file %s", path)
     return tf, nil
 }
@@ -166,6 +205,8 @@ func (tf *TorrentFile) waitForPiece(piece int) error {
         return nil
     }
     tf.log("waiting for piece %d", piece)
+    atomic.AddInt32(&waitingReaders, 1)
+    defer atomic.AddInt32(&waitingReaders, -1)
     for i := piece; i < piece+3; i++ {
         tf.tfs.handle.SetPieceDeadline(i, i-piece*100, 0)
     }
@@ -225,6 +266,7 @@ func (tf *TorrentFile) Read(data []byte) (n int, err error) {
             
             currentOffset += int64(n1)
             piece, pieceOffset = tf.pieceFromOffset(currentOffset)
+            tf.checkBuffer(piece)
         } else {
             return
         }
@@ -233,6 +275,35 @@ func (tf *TorrentFile) Read(data []byte) (n int, err error) {
     return
 }
 
+// checkBuffer tracks whether the -stream-buffer pieces following piece
+// are downloaded, for the adaptive upload throttling.
+func (tf *TorrentFile) checkBuffer(piece int) {
+    if !streamThrottleEnabled() {
+        return
+    }
+    _, endPiece := tf.getPieces()
+    low := false
+    for i := piece + 1; i <= piece+config.streamBuffer && i <= endPiece; i++ {
+        if !tf.hasPiece(i) {
+            low = true
+            break
+        }
+    }
+    tf.setBufferLow(low)
+}
+
+func (tf *TorrentFile) setBufferLow(low bool) {
+    if low == tf.bufferLow {
+        return
+    }
+    tf.bufferLow = low
+    if low {
+        atomic.AddInt32(&lowBufferReaders, 1)
+    } else {
+        atomic.AddInt32(&lowBufferReaders, -1)
+    }
+}
+
 func (tf *TorrentFile) Seek(offset int64, whence int) (int64, error) {
     seekingOffset := offset
 
@@ -293,6 +364,8 @@ func (tf *TorrentFile) Close() error {
     tf.log("closing %s...", tf.path)
 
     tf.closed = true
+    tf.setBufferLow(false)
+    tf.tfs.trackOpen(tf.fileEntryIdx, -1)
     if tf.File == nil {
         return nil
     }
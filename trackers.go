@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+var (
+	curatedTrackersLock sync.RWMutex
+	curatedTrackers     []string
+	// curatedAdded holds, by info-hash, the curated trackers added to each
+	// torrent. A refresh only removes those, not the same URLs coming from
+	// the torrent, the magnet link, -trackers or /trackers.
+	curatedAdded = make(map[string]map[string]bool)
+)
+
+// nextTrackerTier returns the tier following the highest one in use.
+func nextTrackerTier(handle lt.TorrentHandle) int {
+	tier := 0
+	entries := handle.Trackers()
+	defer lt.DeleteStdVectorAnnounceEntry(entries)
+	for i := 0; i < int(entries.Size()); i++ {
+		if t := int(entries.Get(i).GetTier()) + 1; t > tier {
+			tier = t
+		}
+	}
+	return tier
+}
+
+// addTrackers adds urls to the torrent in the given tier. With a negative
+// tier each tracker gets its own tier after the existing ones, the way
+// libtorrent treats the tr= entries of a magnet link.
+func addTrackers(handle lt.TorrentHandle, urls []string, tier int) {
+	nextTier := tier
+	if tier < 0 {
+		nextTier = nextTrackerTier(handle)
+	}
+	for _, tracker := range urls {
+		if nextTier > 255 {
+			nextTier = 255
+		}
+		announceEntry := lt.NewAnnounceEntry(tracker)
+		announceEntry.SetTier(byte(nextTier))
+		log.Printf("adding tracker: %s (tier %d)", tracker, nextTier)
+		handle.AddTracker(announceEntry)
+		lt.DeleteAnnounceEntry(announceEntry)
+		if tier < 0 {
+			nextTier++
+		}
+	}
+}
+
+// removeTrackers removes the given urls from the torrent and returns how
+// many were found. libtorrent can only replace the whole list.
+func removeTrackers(handle lt.TorrentHandle, urls []string) int {
+	remove := make(map[string]bool)
+	for _, tracker := range urls {
+		remove[tracker] = true
+	}
+	entries := handle.Trackers()
+	defer lt.DeleteStdVectorAnnounceEntry(entries)
+	kept := lt.NewStdVectorAnnounceEntry()
+	defer lt.DeleteStdVectorAnnounceEntry(kept)
+	removed := 0
+	for i := 0; i < int(entries.Size()); i++ {
+		entry := entries.Get(i)
+		if remove[entry.GetUrl()] {
+			log.Printf("removing tracker: %s", entry.GetUrl())
+			removed++
+		} else {
+			kept.Add(entry)
+		}
+	}
+	if removed > 0 {
+		handle.ReplaceTrackers(kept)
+	}
+	return removed
+}
+
+// trackerIndex returns the position of url in the tracker list, or -1.
+func trackerIndex(handle lt.TorrentHandle, url string) int {
+	entries := handle.Trackers()
+	defer lt.DeleteStdVectorAnnounceEntry(entries)
+	for i := 0; i < int(entries.Size()); i++ {
+		if entries.Get(i).GetUrl() == url {
+			return i
+		}
+	}
+	return -1
+}
+
+// isPrivateTorrent tells whether handle is a private torrent, which must
+// only announce to its own trackers. Magnet links are not known to be
+// private before the metadata.
+func isPrivateTorrent(handle lt.TorrentHandle) bool {
+	status := handle.Status()
+	defer lt.DeleteTorrentStatus(status)
+	return status.GetHasMetadata() && handle.TorrentFile().Priv()
+}
+
+// addCuratedTrackers adds the curated trackers the torrent doesn't have
+// yet, after its other trackers. Private torrents are left alone.
+func addCuratedTrackers(handle lt.TorrentHandle, trackers []string) {
+	if isPrivateTorrent(handle) {
+		return
+	}
+	var missing []string
+	for _, tracker := range trackers {
+		if trackerIndex(handle, tracker) < 0 {
+			missing = append(missing, tracker)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	infoHash := handle.InfoHash().ToString()
+	curatedTrackersLock.Lock()
+	added := curatedAdded[infoHash]
+	if added == nil {
+		added = make(map[string]bool)
+		curatedAdded[infoHash] = added
+	}
+	for _, tracker := range missing {
+		added[tracker] = true
+	}
+	curatedTrackersLock.Unlock()
+	addTrackers(handle, missing, -1)
+}
+
+// removeCuratedTrackers removes the dropped trackers the curated list
+// added to the torrent.
+func removeCuratedTrackers(handle lt.TorrentHandle, dropped []string) {
+	infoHash := handle.InfoHash().ToString()
+	var urls []string
+	curatedTrackersLock.Lock()
+	for _, tracker := range dropped {
+		if curatedAdded[infoHash][tracker] {
+			delete(curatedAdded[infoHash], tracker)
+			urls = append(urls, tracker)
+		}
+	}
+	curatedTrackersLock.Unlock()
+	if len(urls) > 0 {
+		removeTrackers(handle, urls)
+	}
+}
+
+// forgetCuratedTrackers hands urls over to the user, who added or removed
+// them with /trackers.
+func forgetCuratedTrackers(handle lt.TorrentHandle, urls []string) {
+	infoHash := handle.InfoHash().ToString()
+	curatedTrackersLock.Lock()
+	for _, tracker := range urls {
+		delete(curatedAdded[infoHash], tracker)
+	}
+	curatedTrackersLock.Unlock()
+}
+
+// onCuratedMetadata removes the curated trackers added to a magnet link
+// that turns out to be private.
+func onCuratedMetadata(handle lt.TorrentHandle) {
+	if isPrivateTorrent(handle) {
+		removeCuratedTrackers(handle, getCuratedTrackers())
+	}
+}
+
+func getCuratedTrackers() []string {
+	curatedTrackersLock.RLock()
+	defer curatedTrackersLock.RUnlock()
+	return curatedTrackers
+}
+
+// parseTrackersList reads one tracker URL per line, skipping blank lines
+// and # comments, like the widely shared trackers_best.txt lists.
+func parseTrackersList(data []byte) []string {
+	var trackers []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		trackers = append(trackers, line)
+	}
+	return trackers
+}
+
+// loadCuratedTrackers builds the list from -default-trackers,
+// -trackers-file and -trackers-url.
+func loadCuratedTrackers() ([]string, error) {
+	var trackers []string
+	if config.defaultTrackers {
+		trackers = defaultTrackers
+	}
+	if config.trackersFile != "" {
+		data, err := ioutil.ReadFile(config.trackersFile)
+		if err != nil {
+			return nil, err
+		}
+		trackers = mergeTrackers(trackers, parseTrackersList(data))
+	}
+	if config.trackersURL != "" {
+		client := newHTTPClient()
+		resp, err := client.Get(config.trackersURL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %s", config.trackersURL, resp.Status)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		trackers = mergeTrackers(trackers, parseTrackersList(data))
+	}
+	return trackers, nil
+}
+
+// refreshCuratedTrackers reloads the curated list every -trackers-refresh
+// minutes, adding new trackers to every torrent in the session and
+// removing the ones it added that were dropped from the list.
+func refreshCuratedTrackers() {
+	for {
+		trackers, err := loadCuratedTrackers()
+		if err != nil {
+			log.Printf("unable to load trackers list: %s", err)
+		} else {
+			current := make(map[string]bool)
+			for _, tracker := range trackers {
+				current[tracker] = true
+			}
+			var dropped []string
+			for _, tracker := range getCuratedTrackers() {
+				if !current[tracker] {
+					dropped = append(dropped, tracker)
+				}
+			}
+
+			curatedTrackersLock.Lock()
+			curatedTrackers = trackers
+			curatedTrackersLock.Unlock()
+			log.Printf("loaded %d trackers from trackers list", len(trackers))
+
+			handles := session.GetTorrents()
+			for i := 0; i < int(handles.Size()); i++ {
+				handle := handles.Get(i)
+				if len(dropped) > 0 {
+					removeCuratedTrackers(handle, dropped)
+				}
+				addCuratedTrackers(handle, trackers)
+			}
+			lt.DeleteStdVectorTorrentHandle(handles)
+		}
+		if config.trackersRefresh <= 0 {
+			return
+		}
+		time.Sleep(time.Duration(config.trackersRefresh) * time.Minute)
+	}
+}
+
+func trackersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		r.ParseForm()
+		urls := mergeTrackers(r.Form["url"])
+		if len(urls) == 0 {
+			http.Error(w, "url param missing", http.StatusBadRequest)
+			return
+		}
+		tier := -1
+		if tierStr := r.Form.Get("tier"); tierStr != "" {
+			var err error
+			if tier, err = strconv.Atoi(tierStr); err != nil || tier < 0 || tier > 255 {
+				http.Error(w, "tier must be between 0 and 255", http.StatusBadRequest)
+				return
+			}
+		}
+		forgetCuratedTrackers(torrentHandle, urls)
+		addTrackers(torrentHandle, urls, tier)
+	case "DELETE":
+		r.ParseForm()
+		urls := r.Form["url"]
+		if len(urls) == 0 {
+			http.Error(w, "url param missing", http.StatusBadRequest)
+			return
+		}
+		forgetCuratedTrackers(torrentHandle, urls)
+		if removeTrackers(torrentHandle, urls) == 0 {
+			http.Error(w, "tracker not found", http.StatusNotFound)
+			return
+		}
+	case "GET":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	listTrackers(w)
+}
+
+// reannounceHandler forces an announce to the tracker given by ?url=,
+// or to all of them.
+func reannounceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	if url := r.Form.Get("url"); url != "" {
+		index := trackerIndex(torrentHandle, url)
+		if index < 0 {
+			http.Error(w, "tracker not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("forcing reannounce to %s", url)
+		torrentHandle.ForceReannounce(0, index)
+	} else {
+		log.Println("forcing reannounce to all trackers")
+		torrentHandle.ForceReannounce()
+	}
+	listTrackers(w)
+}
+
+func listTrackers(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ret := TrackersInfo{}
+
+	vectorAnnounceEntry := torrentHandle.Trackers()
+	defer lt.DeleteStdVectorAnnounceEntry(vectorAnnounceEntry)
+	for i := 0; i < int(vectorAnnounceEntry.Size()); i++ {
+		entry := vectorAnnounceEntry.Get(i)
+		pi := TrackerInfo{
+			Url:            entry.GetUrl(),
+			NextAnnounceIn: entry.NextAnnounceIn(),
+			MinAnnounceIn:  entry.MinAnnounceIn(),
+			ErrorCode:      entry.GetLastError().Value(),
+			ErrorMessage:   entry.GetLastError().Message().(string),
+			Message:        entry.GetMessage(),
+			Tier:           entry.GetTier(),
+			FailLimit:      entry.GetFailLimit(),
+			Fails:          entry.GetFails(),
+			Source:         entry.GetSource(),
+			Verified:       entry.GetVerified(),
+			Updating:       entry.GetUpdating(),
+			StartSent:      entry.GetStartSent(),
+			CompleteSent:   entry.GetCompleteSent(),
+		}
+		ret.Trackers = append(ret.Trackers, pi)
+	}
+
+	output, _ := json.Marshal(ret)
+	w.Write(output)
+}
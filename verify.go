@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileCheck is the outcome of verify for one file.
+type FileCheck struct {
+	InspectFile
+	Missing    bool
+	Pieces     int
+	GoodPieces int
+}
+
+// parseSubcommandArgs parses flags placed before or after the positional
+// arguments, e.g. "verify file.torrent -dl-path X".
+func parseSubcommandArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+func formatSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.2f %s", value, units[unit])
+}
+
+// infoCommand runs "torrent2http info <file.torrent>".
+func infoCommand(args []string) int {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	positional, err := parseSubcommandArgs(flags, args)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: torrent2http info <file.torrent>")
+		return 2
+	}
+	meta, err := loadTorrentMeta(positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("name:       %s\n", meta.Name)
+	fmt.Printf("info-hash:  %s\n", meta.InfoHash)
+	fmt.Printf("size:       %s (%d bytes)\n", formatSize(meta.TotalSize), meta.TotalSize)
+	fmt.Printf("piece size: %s (%d pieces)\n", formatSize(meta.PieceLength), len(meta.Pieces))
+	if meta.Private {
+		fmt.Println("private:    yes")
+	}
+	if meta.Comment != "" {
+		fmt.Printf("comment:    %s\n", meta.Comment)
+	}
+	if len(meta.Trackers) > 0 {
+		fmt.Println("trackers:")
+		for _, tracker := range meta.Trackers {
+			fmt.Printf("  %s\n", tracker)
+		}
+	}
+	if len(meta.WebSeeds) > 0 {
+		fmt.Println("web seeds:")
+		for _, seed := range meta.WebSeeds {
+			fmt.Printf("  %s\n", seed)
+		}
+	}
+	fmt.Printf("files (%d):\n", len(meta.Files))
+	for i, file := range meta.Files {
+		if file.Pad {
+			continue
+		}
+		fmt.Printf("  [%d] %s (%s)\n", i, file.Path, formatSize(file.Size))
+	}
+	return 0
+}
+
+// pieceReader reads the data of a torrent from its files in dir, as one
+// stream.
+type pieceReader struct {
+	dir   string
+	files []FileCheck
+}
+
+// readAt fills buf with the torrent data at offset. It reports whether
+// all of it was on disk.
+func (r *pieceReader) readAt(buf []byte, offset int64) bool {
+	complete := true
+	for i := range r.files {
+		file := &r.files[i]
+		start, end := file.Offset, file.Offset+file.Size
+		if end <= offset || start >= offset+int64(len(buf)) || file.Size == 0 {
+			continue
+		}
+		from := offset
+		if from < start {
+			from = start
+		}
+		to := offset + int64(len(buf))
+		if to > end {
+			to = end
+		}
+		chunk := buf[from-offset : to-offset]
+		if file.Pad {
+			for j := range chunk {
+				chunk[j] = 0
+			}
+			continue
+		}
+		if file.Missing {
+			complete = false
+			continue
+		}
+		f, err := os.Open(filepath.Join(r.dir, filepath.FromSlash(file.Path)))
+		if err != nil {
+			file.Missing = true
+			complete = false
+			continue
+		}
+		n, err := f.ReadAt(chunk, from-start)
+		f.Close()
+		if n < len(chunk) || (err != nil && err != io.EOF) {
+			complete = false
+		}
+	}
+	return complete
+}
+
+// verifyTorrent hash-checks the data of meta in dir. It returns the
+// pieces that match, the corrupted pieces (on disk but with a wrong hash)
+// and the state of each file.
+func verifyTorrent(meta *TorrentMeta, dir string) (Bitfield, []int, []FileCheck) {
+	files := make([]FileCheck, len(meta.Files))
+	for i, file := range meta.Files {
+		files[i] = FileCheck{InspectFile: file}
+		if file.Pad {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(file.Path))); err != nil {
+			files[i].Missing = true
+		}
+	}
+	reader := &pieceReader{dir: dir, files: files}
+	pieces := make(Bitfield, (len(meta.Pieces)+7)/8)
+	var corrupted []int
+	buf := make([]byte, meta.PieceLength)
+
+	for piece, hash := range meta.Pieces {
+		offset := int64(piece) * meta.PieceLength
+		length := meta.PieceLength
+		if offset+length > meta.TotalSize {
+			length = meta.TotalSize - offset
+		}
+		complete := reader.readAt(buf[:length], offset)
+		sum := sha1.Sum(buf[:length])
+		good := complete && bytes.Equal(sum[:], []byte(hash))
+		pieces.SetBit(piece, good)
+		if complete && !good {
+			corrupted = append(corrupted, piece)
+		}
+
+		for i := range files {
+			file := &files[i]
+			if file.Size > 0 && !file.Pad && file.Offset < offset+length && file.Offset+file.Size > offset {
+				file.Pieces++
+				if good {
+					file.GoodPieces++
+				}
+			}
+		}
+	}
+	return pieces, corrupted, files
+}
+
+// verifyCommand runs "torrent2http verify <file.torrent> -dl-path <dir>",
+// without joining any swarm.
+func verifyCommand(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := flags.String("dl-path", ".", "Directory of the torrent data")
+	showPieces := flags.Bool("pieces", false, "Print the piece map")
+	positional, err := parseSubcommandArgs(flags, args)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: torrent2http verify <file.torrent> [-dl-path <dir>] [-pieces]")
+		return 2
+	}
+	meta, err := loadTorrentMeta(positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	pieces, corrupted, files := verifyTorrent(meta, *dir)
+	good := 0
+	for i := range meta.Pieces {
+		if pieces.GetBit(i) {
+			good++
+		}
+	}
+	for i, file := range files {
+		if file.Pad {
+			continue
+		}
+		state := "complete"
+		if file.Missing {
+			state = "missing"
+		} else if file.Pieces != file.GoodPieces {
+			state = fmt.Sprintf("%.1f%%", 100*float64(file.GoodPieces)/float64(file.Pieces))
+		}
+		fmt.Printf("[%d] %s: %s (%d/%d pieces)\n", i, file.Path, state, file.GoodPieces, file.Pieces)
+	}
+	if len(corrupted) > 0 {
+		list := make([]string, len(corrupted))
+		for i, piece := range corrupted {
+			list[i] = fmt.Sprint(piece)
+		}
+		fmt.Printf("corrupted pieces: %s\n", strings.Join(list, ", "))
+	}
+	if *showPieces {
+		fmt.Printf("pieces: %s\n", pieces.String()[:len(meta.Pieces)])
+	}
+	if good != len(meta.Pieces) {
+		fmt.Printf("%d/%d pieces ok (%.1f%%)\n", good, len(meta.Pieces), 100*float64(good)/float64(len(meta.Pieces)))
+		return 1
+	}
+	fmt.Printf("%d/%d pieces ok\n", good, len(meta.Pieces))
+	return 0
+}
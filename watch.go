@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	lt "github.com/ElementumOrg/libtorrent-go"
+)
+
+const (
+	watchDoneDir   = "done"
+	watchFailedDir = "failed"
+	// Files modified more recently than this are assumed to be still
+	// being copied into the watch folder.
+	watchSettleTime = 2 * time.Second
+)
+
+var (
+	watchLock sync.Mutex
+	// watchedTorrents holds the info-hashes of torrents added from
+	// -watch-dir.
+	watchedTorrents = map[string]lt.TorrentHandle{}
+)
+
+// watchFolder periodically scans -watch-dir for new .torrent and .magnet
+// files and adds them to the session.
+func watchFolder() {
+	log.Printf("watching folder: %s", config.watchDir)
+	for _, dir := range []string{watchDoneDir, watchFailedDir} {
+		if err := os.MkdirAll(filepath.Join(config.watchDir, dir), 0755); err != nil {
+			log.Println(err)
+		}
+	}
+
+	for {
+		scanWatchFolder()
+		time.Sleep(time.Duration(config.watchInterval) * time.Second)
+	}
+}
+
+func scanWatchFolder() {
+	entries, err := ioutil.ReadDir(config.watchDir)
+	if err != nil {
+		log.Printf("unable to scan watch folder: %s", err)
+		return
+	}
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".torrent" && ext != ".magnet") {
+			continue
+		}
+		if time.Since(entry.ModTime()) < watchSettleTime {
+			continue
+		}
+		filePath := filepath.Join(config.watchDir, entry.Name())
+		if err := addWatchedFile(filePath); err != nil {
+			log.Printf("unable to add %s: %s", entry.Name(), err)
+			publishEvent("watch_failed", "%s: %s", entry.Name(), err)
+			moveWatchedFile(filePath, watchFailedDir)
+		} else {
+			moveWatchedFile(filePath, watchDoneDir)
+		}
+	}
+}
+
+func addWatchedFile(filePath string) error {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return err
+	}
+	// buildTorrentParams strips the leading slash again on windows
+	uriPath := filepath.ToSlash(absPath)
+	if !strings.HasPrefix(uriPath, "/") {
+		uriPath = "/" + uriPath
+	}
+	uri := (&url.URL{Scheme: "file", Path: uriPath}).String()
+	if strings.ToLower(filepath.Ext(filePath)) == ".magnet" {
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		uri = ""
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				uri = line
+				break
+			}
+		}
+		if uri == "" {
+			return fmt.Errorf("no magnet link in file")
+		}
+		uri = magnetFromInfoHash(uri)
+		if !strings.HasPrefix(uri, "magnet:") {
+			return fmt.Errorf("not a magnet link: %s", uri)
+		}
+	}
+
+	infoHash := infoHashFromMagnet(uri)
+	if !strings.HasPrefix(uri, "magnet:") {
+		if _, infoHash, err = bdecodeFile(filePath); err != nil {
+			return err
+		}
+	}
+
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	// checked before adding: libtorrent would hand back the existing
+	// torrent, with the options of the new one applied to it
+	if _, ok := watchedTorrents[infoHash]; ok || activeInfoHashes()[infoHash] {
+		log.Printf("torrent %s is already added", infoHash)
+		return nil
+	}
+
+	torrentParams, err := buildTorrentParams(uri, "")
+	if err != nil {
+		return err
+	}
+	handle, err := addTorrentToSession(torrentParams, parseMagnet(uri))
+	if err != nil {
+		return err
+	}
+
+	status := handle.Status()
+	name := status.GetName()
+	infoHash = hex.EncodeToString([]byte(status.GetInfoHash().ToString()))
+	lt.DeleteTorrentStatus(status)
+	watchedTorrents[infoHash] = handle
+
+	log.Printf("added torrent from watch folder: %s", name)
+	publishEvent("watch_added", "%s (%s)", name, infoHash)
+	return nil
+}
+
+// moveWatchedFile moves a processed file into the given subfolder,
+// keeping any file with the same name that is already there.
+func moveWatchedFile(filePath string, dir string) {
+	target := filepath.Join(config.watchDir, dir, filepath.Base(filePath))
+	if _, err := os.Stat(target); err == nil {
+		ext := filepath.Ext(target)
+		target = fmt.Sprintf("%s.%d%s", strings.TrimSuffix(target, ext), time.Now().Unix(), ext)
+	}
+	if err := os.Rename(filePath, target); err != nil {
+		log.Printf("unable to move %s: %s", filePath, err)
+	}
+}